@@ -0,0 +1,162 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// AnalyticsIngestionData (/analytics/status/ingestion on analytics service)
+type AnalyticsIngestionData struct {
+	Links []struct {
+		Name   string `json:"name"`
+		Scope  string `json:"scope"`
+		Status string `json:"status"`
+		State  []struct {
+			Progress float64 `json:"progress"`
+			Scopes   []struct {
+				Name        string `json:"name"`
+				Collections []struct {
+					Name string `json:"name"`
+				} `json:"collections"`
+			} `json:"scopes"`
+		} `json:"state"`
+	} `json:"links"`
+}
+
+// analyticsClusterRoute is the route of the state of the analytics cluster.
+const analyticsClusterRoute = "/analytics/cluster"
+
+// AnalyticsExporter encapsulates analytics metrics and context.
+type AnalyticsExporter struct {
+	context           Context
+	route             string
+	ingestionProgress *p.Desc
+	ingestionHealthy  *p.Desc
+	clusterMetrics    map[string]typedDesc
+	metrics           map[string]typedDesc
+}
+
+// NewAnalyticsExporter creates the AnalyticsExporter and fill it with metrics metadata from the metrics file.
+func NewAnalyticsExporter(context Context) (*AnalyticsExporter, error) {
+	analyticsMetrics, err := GetMetricsFromFile(context, "analytics")
+	if err != nil {
+		return &AnalyticsExporter{}, err
+	}
+	return &AnalyticsExporter{
+		context: context,
+		route:   analyticsMetrics.Route,
+		ingestionProgress: p.NewDesc(p.BuildFQName("cb", analyticsMetrics.Name, "dataset_ingestion_progress"),
+			"Ratio of the dataset mutations ingested by the analytics service",
+			[]string{"link", "scope", "dataset"}, nil),
+		ingestionHealthy: p.NewDesc(p.BuildFQName("cb", analyticsMetrics.Name, "dataset_ingestion_healthy"),
+			"Whether the link feeding the dataset is healthy. 1:healthy, 0:unhealthy",
+			[]string{"link", "scope", "dataset"}, nil),
+		clusterMetrics: routeMetrics(context, analyticsMetrics, analyticsClusterRoute),
+		metrics:        routeMetrics(context, analyticsMetrics, analyticsMetrics.Route),
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *AnalyticsExporter) Describe(ch chan<- *p.Desc) {
+	ch <- e.ingestionProgress
+	ch <- e.ingestionHealthy
+	for _, metric := range e.clusterMetrics {
+		ch <- metric.desc
+	}
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *AnalyticsExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	nodes, err := serviceNodes(ctx, e.context, "cbas", "8095", "18095")
+	if err != nil {
+		log.Error("Error when retrieving analytics nodes. Analytics metrics won't be scraped")
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	// Cluster state and ingestion status are the same on every analytics node.
+	scrapeErr := e.collectCluster(ctx, ch, nodes[0].context)
+	if err := e.collectIngestion(ctx, ch, nodes[0].context); err != nil {
+		scrapeErr = err
+	}
+
+	bodies, errs := fetchNodes(ctx, e.context, nodes, e.route)
+	for i, node := range nodes {
+		if err, ok := errs[i][e.route]; ok {
+			log.Error("Error when retrieving analytics stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		var stats interface{}
+		err := json.Unmarshal(bodies[i][e.route], &stats)
+		if err != nil {
+			log.Error("Could not unmarshal analytics stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+
+		collectPaths(ch, e.metrics, stats, node.hostname)
+	}
+	return scrapeErr
+}
+
+// collectCluster exports the state of the analytics cluster.
+func (e *AnalyticsExporter) collectCluster(ctx context.Context, ch chan<- p.Metric, c Context) error {
+	body, err := Fetch(ctx, c, analyticsClusterRoute)
+	if err != nil {
+		log.Error("Error when retrieving analytics cluster state")
+		return err
+	}
+	var cluster interface{}
+	err = json.Unmarshal(body, &cluster)
+	if err != nil {
+		log.Error("Could not unmarshal analytics cluster state")
+		return err
+	}
+
+	collectPaths(ch, e.clusterMetrics, cluster)
+	return nil
+}
+
+// collectIngestion exports the ingestion status of each dataset.
+func (e *AnalyticsExporter) collectIngestion(ctx context.Context, ch chan<- p.Metric, c Context) error {
+	body, err := Fetch(ctx, c, "/analytics/status/ingestion")
+	if err != nil {
+		log.Error("Error when retrieving analytics ingestion status")
+		return err
+	}
+	var ingestion AnalyticsIngestionData
+	err = json.Unmarshal(body, &ingestion)
+	if err != nil {
+		log.Error("Could not unmarshal analytics ingestion status")
+		return err
+	}
+
+	for _, link := range ingestion.Links {
+		var healthy float64
+		if link.Status == "healthy" {
+			healthy = 1
+		}
+		for _, state := range link.State {
+			for _, scope := range state.Scopes {
+				for _, dataset := range scope.Collections {
+					ch <- p.MustNewConstMetric(e.ingestionProgress, p.GaugeValue, state.Progress, link.Name, scope.Name, dataset.Name)
+					ch <- p.MustNewConstMetric(e.ingestionHealthy, p.GaugeValue, healthy, link.Name, scope.Name, dataset.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
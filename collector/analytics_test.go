@@ -0,0 +1,59 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAnalyticsClusterAndIngestion(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/analytics/cluster": `{"state": "ACTIVE"}`,
+		"/analytics/status/ingestion": `{"links": [
+			{"name": "Local", "status": "healthy", "state": [
+				{"progress": 1, "scopes": [{"name": "travel", "collections": [{"name": "hotels"}, {"name": "airports"}]}]}
+			]},
+			{"name": "remote", "status": "stopped", "state": [
+				{"progress": 0.25, "scopes": [{"name": "travel", "collections": [{"name": "routes"}]}]}
+			]}
+		]}`,
+	})
+	defer server.Close()
+
+	c := Context{URI: server.URL, Timeout: time.Second}
+	e, err := NewAnalyticsExporter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		if err := e.collectCluster(ctx, ch, c); err != nil {
+			return err
+		}
+		return e.collectIngestion(ctx, ch, c)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hotels := `{dataset="hotels",link="Local",scope="travel"}`
+	airports := `{dataset="airports",link="Local",scope="travel"}`
+	routes := `{dataset="routes",link="remote",scope="travel"}`
+	want := map[string]float64{
+		"cb_analytics_cluster_state":                         1,
+		"cb_analytics_dataset_ingestion_progress" + hotels:   1,
+		"cb_analytics_dataset_ingestion_healthy" + hotels:    1,
+		"cb_analytics_dataset_ingestion_progress" + airports: 1,
+		"cb_analytics_dataset_ingestion_healthy" + airports:  1,
+		"cb_analytics_dataset_ingestion_progress" + routes:   0.25,
+		"cb_analytics_dataset_ingestion_healthy" + routes:    0,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("exported %v, want %v", values, want)
+	}
+}
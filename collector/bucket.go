@@ -5,6 +5,7 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 
 	p "github.com/prometheus/client_golang/prometheus"
@@ -13,36 +14,30 @@ import (
 
 // BucketData (/pools/default/buckets)
 type BucketData struct {
-	Name       string `json:"name"`
-	BasicStats struct {
-		QuotaPercentUsed float64 `json:"quotaPercentUsed"`
-		OpsPerSec        float64 `json:"opsPerSec"`
-		DiskFetches      float64 `json:"diskFetches"`
-		ItemCount        float64 `json:"itemCount"`
-		DiskUsed         float64 `json:"diskUsed"`
-		DataUsed         float64 `json:"dataUsed"`
-		MemUsed          float64 `json:"memUsed"`
-	} `json:"basicStats"`
+	Name  string `json:"name"`
+	Nodes []struct {
+		Hostname string `json:"hostname"`
+	} `json:"nodes"`
 }
 
 // BucketExporter encapsulates bucket metrics and context.
 type BucketExporter struct {
 	context Context
 	route   string
-	metrics map[string]*p.Desc
+	metrics map[string]typedDesc
 }
 
 // NewBucketExporter creates the BucketExporter and fill it with metrics metadata from the metrics file.
 func NewBucketExporter(context Context) (*BucketExporter, error) {
-	bucketMetrics, err := GetMetricsFromFile("bucket")
+	bucketMetrics, err := GetMetricsFromFile(context, "bucket")
 	if err != nil {
 		return &BucketExporter{}, err
 	}
 	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
-	metrics := make(map[string]*p.Desc, len(bucketMetrics.List))
+	metrics := make(map[string]typedDesc, len(bucketMetrics.List))
 	for _, metric := range bucketMetrics.List {
 		fqName := p.BuildFQName("cb", bucketMetrics.Name, metric.Name)
-		metrics[metric.ID] = p.NewDesc(fqName, metric.Description, metric.Labels, nil)
+		metrics[metric.ID] = newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
 	}
 	return &BucketExporter{
 		context: context,
@@ -54,30 +49,27 @@ func NewBucketExporter(context Context) (*BucketExporter, error) {
 // Describe describes exported metrics.
 func (e *BucketExporter) Describe(ch chan<- *p.Desc) {
 	for _, metric := range e.metrics {
-		ch <- metric
+		ch <- metric.desc
 	}
 }
 
-// Collect fetches data for each exported metric.
-func (e *BucketExporter) Collect(ch chan<- p.Metric) {
-	body, err := Fetch(e.context, e.route)
+// Scrape fetches data for each exported metric.
+func (e *BucketExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	body, err := Fetch(ctx, e.context, e.route)
 	if err != nil {
 		log.Error("Error when retrieving buckets data. Buckets metrics won't be scraped")
-		return
+		return err
 	}
-	var buckets []BucketData
+	var buckets []map[string]interface{}
 	err = json.Unmarshal(body, &buckets)
 	if err != nil {
 		log.Error("Could not unmarshal buckets data")
-		return
+		return err
 	}
 
 	for _, bucket := range buckets {
-		flat := FlattenStruct(bucket)
-		for id, metric := range e.metrics {
-			if value, ok := flat[id].(float64); ok {
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, value, bucket.Name)
-			}
-		}
+		name, _ := bucket["name"].(string)
+		collectPaths(ch, e.metrics, bucket, name)
 	}
+	return nil
 }
@@ -0,0 +1,44 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketStatsPerNode(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/pools/default/buckets":                                    `[{"name": "travel", "nodes": [{"hostname": "10.0.0.1:8091"}, {"hostname": "10.0.0.2:8091"}]}]`,
+		"/pools/default/buckets/travel/nodes/10.0.0.1%3A8091/stats": `{"op": {"samples": {"curr_items": [10, 12]}}}`,
+		"/pools/default/buckets/travel/nodes/10.0.0.2%3A8091/stats": `{"op": {"samples": {"curr_items": [20, 21]}}}`,
+	})
+	defer server.Close()
+
+	e, err := NewBucketStatsExporter(Context{URI: server.URL, Timeout: time.Second, ScrapeBucketPerNode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, e)
+	if err != nil {
+		t.Fatalf("Scrape() error = %v", err)
+	}
+
+	got := make(map[string]float64)
+	for name, value := range values {
+		if strings.HasPrefix(name, "cb_bucketstats_curr_items{") {
+			got[name] = value
+		}
+	}
+	want := map[string]float64{
+		`cb_bucketstats_curr_items{bucket="travel",node="10.0.0.1:8091"}`: 12,
+		`cb_bucketstats_curr_items{bucket="travel",node="10.0.0.2:8091"}`: 21,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrape() exported %v, want %v", got, want)
+	}
+}
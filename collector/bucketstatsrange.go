@@ -0,0 +1,284 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsRangeRoute is the route of the stats API of Couchbase 7, which
+// replaces the deprecated stats route of buckets.
+const statsRangeRoute = "/pools/default/stats/range"
+
+// statsRangeBatchSize is the maximum number of queries sent in a single request to the stats API.
+const statsRangeBatchSize = 50
+
+// statsRangeVersion is the version of Couchbase from which the stats API is available.
+var statsRangeVersion = version{7, 0, 0}
+
+// statsQuery is a query of the stats API. Metric selects series by their label
+// values, and functions like irate are applied to the selected series.
+type statsQuery struct {
+	Metric           []statsLabel `json:"metric"`
+	ApplyFunctions   []string     `json:"applyFunctions,omitempty"`
+	NodesAggregation string       `json:"nodesAggregation,omitempty"`
+	AlignTimestamps  bool         `json:"alignTimestamps"`
+	Start            int          `json:"start"`
+	Step             int          `json:"step,omitempty"`
+}
+
+// statsLabel matches series whose label has the given value.
+type statsLabel struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// statsRangeResult is the result of a query of the stats API. Errors are
+// reported for each node that could not be queried.
+type statsRangeResult struct {
+	StatsRangeData
+	Errors []struct {
+		Node  string `json:"node"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+// parseStatsQuery parses the range of a metric definition, written like a PromQL
+// selector wrapped in functions: irate(kv_ops{op='get'}). Only equality
+// matchers are supported.
+func parseStatsQuery(expr string) (statsQuery, error) {
+	var query statsQuery
+	expr = strings.TrimSpace(expr)
+
+	var functions []string
+	for strings.HasSuffix(expr, ")") {
+		open := strings.IndexByte(expr, '(')
+		if open < 0 {
+			return query, fmt.Errorf("unbalanced parenthesis in stats query")
+		}
+		functions = append(functions, strings.TrimSpace(expr[:open]))
+		expr = strings.TrimSpace(expr[open+1 : len(expr)-1])
+	}
+	// Functions are applied from the innermost one.
+	for i := len(functions) - 1; i >= 0; i-- {
+		query.ApplyFunctions = append(query.ApplyFunctions, functions[i])
+	}
+
+	name, matchers := expr, ""
+	if open := strings.IndexByte(expr, '{'); open >= 0 {
+		if !strings.HasSuffix(expr, "}") {
+			return query, fmt.Errorf("unterminated label matchers in stats query")
+		}
+		name, matchers = strings.TrimSpace(expr[:open]), expr[open+1:len(expr)-1]
+	}
+	if name == "" {
+		return query, fmt.Errorf("missing metric name in stats query")
+	}
+	query.Metric = append(query.Metric, statsLabel{Label: "name", Value: name})
+
+	for _, matcher := range strings.Split(matchers, ",") {
+		matcher = strings.TrimSpace(matcher)
+		if matcher == "" {
+			continue
+		}
+		pair := strings.SplitN(matcher, "=", 2)
+		if len(pair) != 2 {
+			return query, fmt.Errorf("invalid label matcher in stats query: %s", matcher)
+		}
+		value := strings.TrimSpace(pair[1])
+		if len(value) < 2 || (value[0] != '\'' && value[0] != '"') || value[len(value)-1] != value[0] {
+			return query, fmt.Errorf("label value must be quoted in stats query: %s", matcher)
+		}
+		query.Metric = append(query.Metric, statsLabel{Label: strings.TrimSpace(pair[0]), Value: value[1 : len(value)-1]})
+	}
+	return query, nil
+}
+
+// collectRange scrapes bucket stats from the stats API. Each metric is queried
+// once for all buckets, and queries are sent in batches. Metrics without range
+// are left to the stats route of buckets.
+func (e *BucketStatsExporter) collectRange(ctx context.Context, ch chan<- p.Metric, buckets []BucketData) error {
+	ids := make([]string, 0, len(e.queries))
+	for id := range e.queries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// The sample window of the stats route of buckets is a minute with a
+	// sample per second, so only the last seconds are needed otherwise.
+	start, step := -10, 0
+	if e.context.ScrapeSampleWindow {
+		start, step = -60, 1
+	}
+	queries := make([]statsQuery, len(ids))
+	for i, id := range ids {
+		query := e.queries[id]
+		query.AlignTimestamps = true
+		query.Start, query.Step = start, step
+		if !e.context.ScrapeBucketPerNode {
+			query.NodesAggregation = "sum"
+		}
+		queries[i] = query
+	}
+
+	results, scrapeErr := queryStatsRangeBatches(ctx, e.context, queries)
+	if scrapeErr != nil {
+		log.Error("Error when retrieving bucketstats data from the stats API")
+	}
+
+	// Stats of deleted buckets can still be returned for a while.
+	current := make(map[string]bool, len(buckets))
+	for _, bucket := range buckets {
+		current[bucket.Name] = true
+	}
+
+	for i, id := range ids {
+		for _, queryErr := range results[i].Errors {
+			log.Debug("Could not query " + id + " stats on node " + queryErr.Node + ": " + queryErr.Error)
+		}
+		metric := e.metrics[id]
+		for key, samples := range sumByBucket(results[i].StatsRangeData, e.context.ScrapeBucketPerNode) {
+			if !current[key[0]] {
+				continue
+			}
+			labels := []string{key[0]}
+			if e.context.ScrapeBucketPerNode {
+				labels = append(labels, key[1])
+			}
+			if v, ok := metric.value(samples[len(samples)-1]); ok {
+				ch <- metric.mustNewConstMetric(v, labels...)
+			}
+			metric.collectWindow(ch, samples, labels...)
+		}
+	}
+	return scrapeErr
+}
+
+// queryStatsRangeBatches sends queries to the stats API in batches of
+// statsRangeBatchSize queries, with at most MaxConcurrency requests at a time.
+// Results are returned in the order of the queries, and are empty for the
+// queries of failed batches, along with the error of one of them.
+func queryStatsRangeBatches(ctx context.Context, c Context, queries []statsQuery) ([]statsRangeResult, error) {
+	results := make([]statsRangeResult, len(queries))
+	batches := (len(queries) + statsRangeBatchSize - 1) / statsRangeBatchSize
+	if batches == 0 {
+		return results, nil
+	}
+	workers := c.MaxConcurrency
+	if workers <= 0 || workers > batches {
+		workers = batches
+	}
+	errs := make([]error, batches)
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for batch := 0; batch < batches; batch++ {
+		first := batch * statsRangeBatchSize
+		last := first + statsRangeBatchSize
+		if last > len(queries) {
+			last = len(queries)
+		}
+		wg.Add(1)
+		go func(batch, first, last int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs[batch] = queryStatsRange(ctx, c, queries[first:last], results[first:last])
+		}(batch, first, last)
+	}
+	wg.Wait()
+
+	var err error
+	for _, batchErr := range errs {
+		if batchErr != nil {
+			err = batchErr
+		}
+	}
+	return results, err
+}
+
+// queryStatsRange sends queries to the stats API and stores their results,
+// which are returned in the order of the queries, into results.
+func queryStatsRange(ctx context.Context, c Context, queries []statsQuery, results []statsRangeResult) error {
+	payload, err := json.Marshal(queries)
+	if err != nil {
+		return err
+	}
+	body, err := Post(ctx, c, statsRangeRoute, payload)
+	if err != nil {
+		return err
+	}
+	var batch []statsRangeResult
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		return err
+	}
+	if len(batch) != len(queries) {
+		return fmt.Errorf("stats API returned %d results for %d queries", len(batch), len(queries))
+	}
+	copy(results, batch)
+	return nil
+}
+
+// sumByBucket sums the values of series sharing the same bucket, and the same
+// node when perNode is true, for each timestamp. Samples are returned in time
+// order, and series without samples are left out.
+func sumByBucket(stats StatsRangeData, perNode bool) map[[2]string][]interface{} {
+	sums := make(map[[2]string]map[float64]float64)
+	for _, series := range stats.Data {
+		bucket, _ := series.Metric["bucket"].(string)
+		if bucket == "" {
+			continue
+		}
+		var node string
+		if perNode {
+			// Series that are not aggregated over nodes list the node they come from.
+			nodes, _ := series.Metric["nodes"].([]interface{})
+			if len(nodes) != 1 {
+				continue
+			}
+			node, _ = nodes[0].(string)
+		}
+		key := [2]string{bucket, node}
+		for _, pair := range series.Values {
+			// Values are given as [timestamp, "value"] pairs.
+			if len(pair) != 2 {
+				continue
+			}
+			timestamp, ok := pair[0].(float64)
+			raw, _ := pair[1].(string)
+			value, err := strconv.ParseFloat(raw, 64)
+			if !ok || err != nil || math.IsNaN(value) {
+				continue
+			}
+			if sums[key] == nil {
+				sums[key] = make(map[float64]float64)
+			}
+			sums[key][timestamp] += value
+		}
+	}
+
+	samples := make(map[[2]string][]interface{}, len(sums))
+	for key, values := range sums {
+		timestamps := make([]float64, 0, len(values))
+		for timestamp := range values {
+			timestamps = append(timestamps, timestamp)
+		}
+		sort.Float64s(timestamps)
+		for _, timestamp := range timestamps {
+			samples[key] = append(samples[key], values[timestamp])
+		}
+	}
+	return samples
+}
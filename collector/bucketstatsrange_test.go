@@ -0,0 +1,120 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseStatsQuery(t *testing.T) {
+	tests := []struct {
+		expr  string
+		query statsQuery
+		err   bool
+	}{
+		{
+			expr:  "kv_curr_items",
+			query: statsQuery{Metric: []statsLabel{{Label: "name", Value: "kv_curr_items"}}},
+		},
+		{
+			expr: "irate(kv_ops{op='get'})",
+			query: statsQuery{
+				Metric:         []statsLabel{{Label: "name", Value: "kv_ops"}, {Label: "op", Value: "get"}},
+				ApplyFunctions: []string{"irate"},
+			},
+		},
+		{
+			expr: ` sum( irate( kv_ops{ op="get", result = 'hit' } ) ) `,
+			query: statsQuery{
+				Metric:         []statsLabel{{Label: "name", Value: "kv_ops"}, {Label: "op", Value: "get"}, {Label: "result", Value: "hit"}},
+				ApplyFunctions: []string{"irate", "sum"},
+			},
+		},
+		{
+			expr:  "kv_ep_queue_size{}",
+			query: statsQuery{Metric: []statsLabel{{Label: "name", Value: "kv_ep_queue_size"}}},
+		},
+		{expr: "", err: true},
+		{expr: "irate()", err: true},
+		{expr: "{op='get'}", err: true},
+		{expr: "kv_ops)", err: true},
+		{expr: "kv_ops{op='get'", err: true},
+		{expr: "kv_ops{op}", err: true},
+		{expr: "kv_ops{op=get}", err: true},
+		{expr: "kv_ops{op='get\"}", err: true},
+	}
+	for _, test := range tests {
+		query, err := parseStatsQuery(test.expr)
+		if (err != nil) != test.err {
+			t.Errorf("parseStatsQuery(%q) error = %v, want error %v", test.expr, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(query, test.query) {
+			t.Errorf("parseStatsQuery(%q) = %+v, want %+v", test.expr, query, test.query)
+		}
+	}
+}
+
+func TestSumByBucket(t *testing.T) {
+	var stats StatsRangeData
+	err := json.Unmarshal([]byte(`{"data": [
+		{"metric": {"bucket": "b1", "op": "get", "nodes": ["n1"]}, "values": [[100, "1"], [101, "2"]]},
+		{"metric": {"bucket": "b1", "op": "set", "nodes": ["n1"]}, "values": [[101, "3"], [100, "4"]]},
+		{"metric": {"bucket": "b1", "op": "get", "nodes": ["n2"]}, "values": [[100, "5"], [101, "NaN"]]},
+		{"metric": {"bucket": "b2", "nodes": ["n1", "n2"]}, "values": [[100, "6"]]},
+		{"metric": {"bucket": "b3", "nodes": ["n1"]}, "values": [[100, "NaN"]]},
+		{"metric": {"nodes": ["n1"]}, "values": [[100, "7"]]}
+	]}`), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		perNode bool
+		samples map[[2]string][]interface{}
+	}{
+		{
+			name: "by bucket",
+			samples: map[[2]string][]interface{}{
+				{"b1", ""}: {10.0, 5.0},
+				{"b2", ""}: {6.0},
+			},
+		},
+		{
+			name:    "by bucket and node",
+			perNode: true,
+			samples: map[[2]string][]interface{}{
+				{"b1", "n1"}: {5.0, 5.0},
+				{"b1", "n2"}: {5.0},
+			},
+		},
+	}
+	for _, test := range tests {
+		samples := sumByBucket(stats, test.perNode)
+		if !reflect.DeepEqual(samples, test.samples) {
+			t.Errorf("%s: sumByBucket() = %v, want %v", test.name, samples, test.samples)
+		}
+	}
+}
+
+func TestNewBucketStatsExporter(t *testing.T) {
+	for _, perNode := range []bool{false, true} {
+		e, err := NewBucketStatsExporter(Context{ScrapeBucketPerNode: perNode})
+		if err != nil {
+			t.Fatalf("NewBucketStatsExporter() error = %v", err)
+		}
+		if len(e.queries) == 0 || len(e.queries)+len(e.legacy) != len(e.metrics) {
+			t.Errorf("NewBucketStatsExporter() has %d queries and %d legacy metrics for %d metrics", len(e.queries), len(e.legacy), len(e.metrics))
+		}
+		for id := range e.legacy {
+			if _, ok := e.queries[id]; ok {
+				t.Errorf("NewBucketStatsExporter() reads %s from both the stats API and the stats route", id)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// lastScrapeMetric is the name of the metric holding the time of the last scrape of a Cache.
+const lastScrapeMetric = "cb_exporter_last_scrape_timestamp_seconds"
+
+// Cache scrapes collectors in the background at a fixed interval and keeps the
+// metrics of the last scrape. It is a Prometheus gatherer serving these metrics
+// until they are older than its maximum age.
+type Cache struct {
+	collectors *Collectors
+	interval   time.Duration
+	maxAge     time.Duration
+
+	mu        sync.RWMutex
+	families  []*dto.MetricFamily
+	timestamp time.Time
+
+	// stale is 1 while metrics are too old to be served, so that it is
+	// logged once rather than on every request.
+	stale int32
+}
+
+// NewCache creates a Cache scraping collectors every interval. Metrics older
+// than maxAge are dropped.
+func NewCache(collectors *Collectors, interval, maxAge time.Duration) *Cache {
+	return &Cache{
+		collectors: collectors,
+		interval:   interval,
+		maxAge:     maxAge,
+	}
+}
+
+// Run scrapes the collectors right away and then every interval until ctx is done.
+func (c *Cache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.scrape(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scrape gathers the metrics of the collectors. A scrape can't last longer
+// than the interval, so that scrapes don't overlap.
+func (c *Cache) scrape(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+
+	start := time.Now()
+	registry := p.NewRegistry()
+	registry.MustRegister(c.collectors.Bind(ctx))
+	families, err := registry.Gather()
+	if err != nil {
+		// Gather returns the metrics it could gather along with the error.
+		log.Error("Error when gathering metrics: ", err)
+	}
+	log.Debug("Background scrape done (" + time.Since(start).String() + ")")
+
+	c.mu.Lock()
+	c.families = families
+	c.timestamp = start
+	c.mu.Unlock()
+}
+
+// Gather returns the metrics of the last scrape along with its timestamp.
+// Metrics are left out when they are older than the maximum age of the cache.
+func (c *Cache) Gather() ([]*dto.MetricFamily, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.timestamp.IsZero() {
+		return nil, nil
+	}
+
+	name := lastScrapeMetric
+	help := "Time of the last background scrape of the cluster, in unix seconds"
+	value := float64(c.timestamp.UnixNano()) / 1e9
+	families := []*dto.MetricFamily{{
+		Name:   &name,
+		Help:   &help,
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &value}}},
+	}}
+
+	if time.Since(c.timestamp) > c.maxAge {
+		if atomic.CompareAndSwapInt32(&c.stale, 0, 1) {
+			log.Warn("Metrics of the last background scrape are older than ", c.maxAge, " and won't be served")
+		}
+		return families, nil
+	}
+	if atomic.CompareAndSwapInt32(&c.stale, 1, 0) {
+		log.Info("Metrics of the background scrape are served again")
+	}
+	return append(families, c.families...), nil
+}
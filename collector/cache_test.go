@@ -0,0 +1,60 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCacheGather(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	name := "cb_cluster_ram_total_bytes"
+	c := NewCache(nil, time.Second, time.Minute)
+	c.families = []*dto.MetricFamily{{Name: &name}}
+
+	families, err := c.Gather()
+	if err != nil || len(families) != 0 {
+		t.Fatalf("Gather() before the first scrape = %v, %v, want no metrics", families, err)
+	}
+
+	tests := []struct {
+		name     string
+		age      time.Duration
+		families []string
+		logs     int
+	}{
+		{name: "fresh", age: time.Second, families: []string{lastScrapeMetric, name}},
+		{name: "stale", age: 2 * time.Minute, families: []string{lastScrapeMetric}, logs: 1},
+		{name: "still stale", age: 3 * time.Minute, families: []string{lastScrapeMetric}},
+		{name: "recovered", age: time.Second, families: []string{lastScrapeMetric, name}, logs: 1},
+		{name: "still fresh", age: 2 * time.Second, families: []string{lastScrapeMetric, name}},
+	}
+	for _, test := range tests {
+		hook.Reset()
+		c.timestamp = time.Now().Add(-test.age)
+		families, err := c.Gather()
+		if err != nil {
+			t.Fatalf("%s: Gather() error = %v", test.name, err)
+		}
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		if !reflect.DeepEqual(names, test.families) {
+			t.Errorf("%s: Gather() returned %v, want %v", test.name, names, test.families)
+		}
+		if len(hook.Entries) != test.logs {
+			t.Errorf("%s: Gather() logged %d times, want %d", test.name, len(hook.Entries), test.logs)
+		}
+	}
+}
@@ -5,63 +5,62 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
 
 	p "github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-// ClusterData (/pools/default)
-type ClusterData struct {
-	StorageTotals struct {
-		RAM struct {
-			Total      float64 `json:"total"`
-			QuotaTotal float64 `json:"quotaTotal"`
-			QuotaUsed  float64 `json:"quotaUsed"`
-			Used       float64 `json:"used"`
-			UsedByData float64 `json:"usedByData"`
-		} `json:"ram"`
-		Hdd struct {
-			Total      float64 `json:"total"`
-			QuotaTotal float64 `json:"quotaTotal"`
-			Used       float64 `json:"used"`
-			UsedByData float64 `json:"usedByData"`
-			Free       float64 `json:"free"`
-		} `json:"hdd"`
-	} `json:"storageTotals"`
-	FtsMemoryQuota   float64 `json:"ftsMemoryQuota"`
-	IndexMemoryQuota float64 `json:"indexMemoryQuota"`
-	MemoryQuota      float64 `json:"memoryQuota"`
-	RebalanceStatus  string  `json:"rebalanceStatus"`
-	MaxBucketCount   float64 `json:"maxBucketCount"`
-	Counters         struct {
-		FailoverNode     float64 `json:"failover_node"`
-		RebalanceSuccess float64 `json:"rebalance_success"`
-		RebalanceStart   float64 `json:"rebalance_start"`
-		RebalanceFail    float64 `json:"rebalance_fail"`
-	} `json:"counters"`
-	Balanced bool `json:"balanced"` // couchbase 5.1.1
+const (
+	serverGroupsRoute = "/pools/default/serverGroups"
+	autoFailoverRoute = "/settings/autoFailover"
+)
+
+// ServerGroupsData (/pools/default/serverGroups)
+type ServerGroupsData struct {
+	Groups []struct {
+		Name  string `json:"name"`
+		Nodes []struct {
+			Hostname string `json:"hostname"`
+		} `json:"nodes"`
+	} `json:"groups"`
+}
+
+// AutoFailoverData (/settings/autoFailover)
+type AutoFailoverData struct {
+	Enabled bool    `json:"enabled"`
+	Timeout float64 `json:"timeout"`
+	Count   float64 `json:"count"`
 }
 
 // ClusterExporter encapsulates cluster metrics and context.
 type ClusterExporter struct {
-	context      Context
-	route        string
-	totalScrapes p.Counter
-	metrics      map[string]*p.Desc
+	context             Context
+	route               string
+	totalScrapes        p.Counter
+	nodes               *p.Desc
+	serverGroupNodes    *p.Desc
+	autoFailoverEnabled *p.Desc
+	autoFailoverTimeout *p.Desc
+	autoFailoverCount   *p.Desc
+	metrics             map[string]typedDesc
 }
 
 // NewClusterExporter creates the ClusterExporter and fill it with metrics metadata from the metrics file.
 func NewClusterExporter(context Context) (*ClusterExporter, error) {
-	clusterMetrics, err := GetMetricsFromFile("cluster")
+	clusterMetrics, err := GetMetricsFromFile(context, "cluster")
 	if err != nil {
 		return &ClusterExporter{}, err
 	}
 	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
-	metrics := make(map[string]*p.Desc, len(clusterMetrics.List))
+	metrics := make(map[string]typedDesc, len(clusterMetrics.List))
 	for _, metric := range clusterMetrics.List {
 		fqName := p.BuildFQName("cb", clusterMetrics.Name, metric.Name)
-		metrics[metric.ID] = p.NewDesc(fqName, metric.Description, metric.Labels, nil)
+		metrics[metric.ID] = newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
 	}
 	return &ClusterExporter{
 		context: context,
@@ -70,6 +69,21 @@ func NewClusterExporter(context Context) (*ClusterExporter, error) {
 			Name: p.BuildFQName("cb", clusterMetrics.Name, "scrapes_total"),
 			Help: "Number of scrapes since the start of the exporter.",
 		}),
+		nodes: p.NewDesc(p.BuildFQName("cb", clusterMetrics.Name, "nodes"),
+			"Number of nodes of the cluster by status, membership and services",
+			[]string{"status", "membership", "services"}, nil),
+		serverGroupNodes: p.NewDesc(p.BuildFQName("cb", clusterMetrics.Name, "server_group_nodes"),
+			"Number of nodes in the server group",
+			[]string{"group"}, nil),
+		autoFailoverEnabled: p.NewDesc(p.BuildFQName("cb", clusterMetrics.Name, "autofailover_enabled"),
+			"Whether automatic failover is enabled. 1:enabled, 0:disabled",
+			nil, nil),
+		autoFailoverTimeout: p.NewDesc(p.BuildFQName("cb", clusterMetrics.Name, "autofailover_timeout_seconds"),
+			"Time before an unresponsive node is failed over",
+			nil, nil),
+		autoFailoverCount: p.NewDesc(p.BuildFQName("cb", clusterMetrics.Name, "autofailover_count"),
+			"Number of automatic failovers since last reset",
+			nil, nil),
 		metrics: metrics,
 	}, nil
 }
@@ -77,48 +91,113 @@ func NewClusterExporter(context Context) (*ClusterExporter, error) {
 // Describe describes exported metrics.
 func (e *ClusterExporter) Describe(ch chan<- *p.Desc) {
 	ch <- e.totalScrapes.Desc()
+	ch <- e.nodes
+	ch <- e.serverGroupNodes
+	ch <- e.autoFailoverEnabled
+	ch <- e.autoFailoverTimeout
+	ch <- e.autoFailoverCount
 	for _, metric := range e.metrics {
-		ch <- metric
+		ch <- metric.desc
 	}
 }
 
-// Collect fetches data for each exported metric.
-func (e *ClusterExporter) Collect(ch chan<- p.Metric) {
+// Scrape fetches data for each exported metric.
+func (e *ClusterExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
 	e.totalScrapes.Inc()
 	ch <- e.totalScrapes
 
-	body, err := Fetch(e.context, e.route)
-	if err != nil {
+	bodies, errs := MultiFetch(ctx, e.context, []string{e.route, serverGroupsRoute, autoFailoverRoute})
+
+	if err, ok := errs[e.route]; ok {
 		log.Error("Error when retrieving cluster data. Cluster metrics won't be scraped")
-		return
+		return err
 	}
-	var cluster ClusterData
-	err = json.Unmarshal(body, &cluster)
+	var cluster interface{}
+	err := json.Unmarshal(bodies[e.route], &cluster)
 	if err != nil {
 		log.Error("Could not unmarshal cluster data")
-		return
-	}
-
-	flat := FlattenStruct(cluster)
-	for id, metric := range e.metrics {
-		if value, ok := flat[id]; ok {
-			switch value.(type) {
-			case bool:
-				var v float64
-				// Rebalance status
-				if value.(bool) {
-					v = 1
-				}
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, v)
-			case string:
-				var v float64
-				if value.(string) != "none" {
-					v = 1
-				}
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, v)
-			case float64:
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, value.(float64))
-			}
-		}
+		return err
+	}
+	collectPaths(ch, e.metrics, cluster)
+
+	var scrapeErr error
+	err = e.collectNodes(ch, bodies[e.route])
+	if err != nil {
+		log.Error("Could not unmarshal nodes of the cluster")
+		scrapeErr = err
+	}
+	err = e.collectServerGroups(ch, bodies[serverGroupsRoute], errs[serverGroupsRoute])
+	if err != nil {
+		log.Error("Could not retrieve server groups data")
+		scrapeErr = err
+	}
+	err = e.collectAutoFailover(ch, bodies[autoFailoverRoute], errs[autoFailoverRoute])
+	if err != nil {
+		log.Error("Could not retrieve auto-failover settings")
+		scrapeErr = err
+	}
+	return scrapeErr
+}
+
+// collectNodes counts the nodes of the cluster by status, membership and services.
+func (e *ClusterExporter) collectNodes(ch chan<- p.Metric, body []byte) error {
+	var cluster struct {
+		Nodes []NodeData `json:"nodes"`
+	}
+	err := json.Unmarshal(body, &cluster)
+	if err != nil {
+		return err
+	}
+	counts := make(map[[3]string]float64)
+	for _, node := range cluster.Nodes {
+		services := append([]string{}, node.Services...)
+		sort.Strings(services)
+		counts[[3]string{node.Status, node.ClusterMembership, strings.Join(services, ",")}]++
+	}
+	for labels, count := range counts {
+		ch <- p.MustNewConstMetric(e.nodes, p.GaugeValue, count, labels[:]...)
+	}
+	return nil
+}
+
+// collectServerGroups counts the nodes of each server group. Server groups
+// are only available in the enterprise edition, so client errors are ignored.
+func (e *ClusterExporter) collectServerGroups(ch chan<- p.Metric, body []byte, err error) error {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.Code >= 400 && statusErr.Code < 500 {
+		log.Debug("Server groups are not available: ", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var serverGroups ServerGroupsData
+	err = json.Unmarshal(body, &serverGroups)
+	if err != nil {
+		return err
+	}
+	for _, group := range serverGroups.Groups {
+		ch <- p.MustNewConstMetric(e.serverGroupNodes, p.GaugeValue, float64(len(group.Nodes)), group.Name)
+	}
+	return nil
+}
+
+// collectAutoFailover exports the auto-failover settings of the cluster.
+func (e *ClusterExporter) collectAutoFailover(ch chan<- p.Metric, body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	var autoFailover AutoFailoverData
+	err = json.Unmarshal(body, &autoFailover)
+	if err != nil {
+		return err
+	}
+	var enabled float64
+	if autoFailover.Enabled {
+		enabled = 1
 	}
+	ch <- p.MustNewConstMetric(e.autoFailoverEnabled, p.GaugeValue, enabled)
+	ch <- p.MustNewConstMetric(e.autoFailoverTimeout, p.GaugeValue, autoFailover.Timeout)
+	ch <- p.MustNewConstMetric(e.autoFailoverCount, p.GaugeValue, autoFailover.Count)
+	return nil
 }
@@ -0,0 +1,88 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClusterTopology(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string]string
+		want   map[string]float64
+		absent []string
+		err    bool
+	}{
+		{
+			name: "enterprise",
+			routes: map[string]string{
+				"/pools/default": `{"storageTotals": {"ram": {"total": 100}}, "nodes": [
+					{"hostname": "10.0.0.1:8091", "status": "healthy", "clusterMembership": "active", "services": ["kv", "index"]},
+					{"hostname": "10.0.0.2:8091", "status": "healthy", "clusterMembership": "active", "services": ["index", "kv"]},
+					{"hostname": "10.0.0.3:8091", "status": "unhealthy", "clusterMembership": "inactiveFailed", "services": ["n1ql"]}
+				]}`,
+				"/pools/default/serverGroups": `{"groups": [
+					{"name": "rack 1", "nodes": [{"hostname": "10.0.0.1:8091"}, {"hostname": "10.0.0.3:8091"}]},
+					{"name": "rack 2", "nodes": [{"hostname": "10.0.0.2:8091"}]}
+				]}`,
+				"/settings/autoFailover": `{"enabled": true, "timeout": 120, "count": 1}`,
+			},
+			want: map[string]float64{
+				"cb_cluster_ram_total_bytes": 100,
+				`cb_cluster_nodes{membership="active",services="index,kv",status="healthy"}`:       2,
+				`cb_cluster_nodes{membership="inactiveFailed",services="n1ql",status="unhealthy"}`: 1,
+				`cb_cluster_server_group_nodes{group="rack 1"}`:                                    2,
+				`cb_cluster_server_group_nodes{group="rack 2"}`:                                    1,
+				"cb_cluster_autofailover_enabled":                                                  1,
+				"cb_cluster_autofailover_timeout_seconds":                                          120,
+				"cb_cluster_autofailover_count":                                                    1,
+			},
+		},
+		{
+			name: "community",
+			routes: map[string]string{
+				"/pools/default":         `{"nodes": [{"hostname": "10.0.0.1:8091", "status": "healthy", "clusterMembership": "active", "services": ["kv"]}]}`,
+				"/settings/autoFailover": `{"enabled": false, "timeout": 120, "count": 0}`,
+			},
+			want: map[string]float64{
+				`cb_cluster_nodes{membership="active",services="kv",status="healthy"}`: 1,
+				"cb_cluster_autofailover_enabled":                                      0,
+			},
+			absent: []string{`cb_cluster_server_group_nodes{group="rack 1"}`},
+		},
+		{
+			name: "auto-failover settings unavailable",
+			routes: map[string]string{
+				"/pools/default": `{"nodes": []}`,
+			},
+			absent: []string{"cb_cluster_autofailover_enabled"},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		server := serveRoutes(test.routes)
+		e, err := NewClusterExporter(Context{URI: server.URL, Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := scrapeMetrics(t, e)
+		server.Close()
+		if (err != nil) != test.err {
+			t.Errorf("%s: Scrape() error = %v, want error %v", test.name, err, test.err)
+		}
+		for name, value := range test.want {
+			if got, ok := values[name]; !ok || got != value {
+				t.Errorf("%s: %s = %v (exported: %v), want %v", test.name, name, got, ok, value)
+			}
+		}
+		for _, name := range test.absent {
+			if _, ok := values[name]; ok {
+				t.Errorf("%s: %s exported", test.name, name)
+			}
+		}
+	}
+}
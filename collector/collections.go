@@ -0,0 +1,208 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// CollectionsManifestData (/pools/default/buckets/<bucket_name>/scopes)
+type CollectionsManifestData struct {
+	UID    string `json:"uid"`
+	Scopes []struct {
+		Name        string `json:"name"`
+		Collections []struct {
+			Name string `json:"name"`
+		} `json:"collections"`
+	} `json:"scopes"`
+}
+
+// StatsRangeData (/pools/default/stats/range/<metric_name>)
+type StatsRangeData struct {
+	Data []struct {
+		Metric map[string]interface{} `json:"metric"`
+		Values [][]interface{}        `json:"values"`
+	} `json:"data"`
+}
+
+// CollectionsExporter encapsulates scopes and collections metrics and context.
+// Metrics are read from the stats API with the query given by their range.
+type CollectionsExporter struct {
+	context     Context
+	manifestUID *p.Desc
+	metrics     map[string]typedDesc
+	queries     map[string]statsQuery
+}
+
+// collectionLabels are the labels of collections metrics, given by the exporter.
+var collectionLabels = []string{"bucket", "scope", "collection"}
+
+// NewCollectionsExporter creates the CollectionsExporter and fill it with metrics metadata from the metrics file.
+func NewCollectionsExporter(context Context) (*CollectionsExporter, error) {
+	collectionsMetrics, err := GetMetricsFromFile(context, "collections")
+	if err != nil {
+		return &CollectionsExporter{}, err
+	}
+	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
+	metrics := make(map[string]typedDesc, len(collectionsMetrics.List))
+	// queries holds the query of the stats API of each metric ID.
+	queries := make(map[string]statsQuery, len(collectionsMetrics.List))
+	for _, metric := range collectionsMetrics.List {
+		if strings.Join(metric.Labels, ",") != strings.Join(collectionLabels, ",") {
+			return &CollectionsExporter{}, fmt.Errorf("collections metric %s must have bucket, scope and collection labels", metric.Name)
+		}
+		query, err := parseStatsQuery(metric.Range)
+		if err != nil {
+			return &CollectionsExporter{}, fmt.Errorf("invalid range of collections metric %s: %v", metric.Name, err)
+		}
+		fqName := p.BuildFQName("cb", collectionsMetrics.Name, metric.Name)
+		metrics[metric.ID] = newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
+		queries[metric.ID] = query
+	}
+	return &CollectionsExporter{
+		context: context,
+		manifestUID: p.NewDesc(p.BuildFQName("cb", collectionsMetrics.Name, "manifest_uid"),
+			"UID of the collections manifest of the bucket, incremented on each change",
+			[]string{"bucket"}, nil),
+		metrics: metrics,
+		queries: queries,
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *CollectionsExporter) Describe(ch chan<- *p.Desc) {
+	ch <- e.manifestUID
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *CollectionsExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	body, err := Fetch(ctx, e.context, "/pools/default/buckets")
+	if err != nil {
+		log.Error("Error when retrieving buckets data. Collections metrics won't be scraped")
+		return err
+	}
+	var buckets []BucketData
+	err = json.Unmarshal(body, &buckets)
+	if err != nil {
+		log.Error("Could not unmarshal buckets data")
+		return err
+	}
+
+	// Each bucket has its own manifest.
+	manifestRoutes := make(map[string]string, len(buckets))
+	routes := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		manifestRoutes[bucket.Name] = "/pools/default/buckets/" + url.PathEscape(bucket.Name) + "/scopes"
+		routes = append(routes, manifestRoutes[bucket.Name])
+	}
+	bodies, errs := MultiFetch(ctx, e.context, routes)
+
+	var scrapeErr error
+	// Stats of dropped collections can still be returned for a while, so
+	// only collections of the current manifests are exported.
+	current := make(map[[3]string]bool)
+	for _, bucket := range buckets {
+		if err, ok := errs[manifestRoutes[bucket.Name]]; ok {
+			log.Error("Error when retrieving collections manifest of bucket " + bucket.Name)
+			scrapeErr = err
+			continue
+		}
+		var manifest CollectionsManifestData
+		err = json.Unmarshal(bodies[manifestRoutes[bucket.Name]], &manifest)
+		if err != nil {
+			log.Error("Could not unmarshal collections manifest of bucket " + bucket.Name)
+			scrapeErr = err
+			continue
+		}
+		// Manifest UID is an hexadecimal string.
+		uid, err := strconv.ParseUint(manifest.UID, 16, 64)
+		if err == nil {
+			ch <- p.MustNewConstMetric(e.manifestUID, p.GaugeValue, float64(uid), bucket.Name)
+		}
+		for _, scope := range manifest.Scopes {
+			for _, collection := range scope.Collections {
+				current[[3]string{bucket.Name, scope.Name, collection.Name}] = true
+			}
+		}
+	}
+	if len(current) == 0 {
+		return scrapeErr
+	}
+
+	// Each metric is queried once for all buckets.
+	ids := make([]string, 0, len(e.queries))
+	for id := range e.queries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	queries := make([]statsQuery, len(ids))
+	for i, id := range ids {
+		query := e.queries[id]
+		query.AlignTimestamps = true
+		query.Start = -10
+		query.NodesAggregation = "sum"
+		queries[i] = query
+	}
+	results, err := queryStatsRangeBatches(ctx, e.context, queries)
+	if err != nil {
+		log.Error("Error when retrieving collections data from the stats API")
+		scrapeErr = err
+	}
+
+	for i, id := range ids {
+		for _, queryErr := range results[i].Errors {
+			log.Debug("Could not query " + id + " stats on node " + queryErr.Node + ": " + queryErr.Error)
+		}
+		metric := e.metrics[id]
+		for key, value := range sumByCollection(results[i].StatsRangeData) {
+			if !current[key] {
+				continue
+			}
+			if v, ok := metric.value(value); ok {
+				ch <- metric.mustNewConstMetric(v, key[:]...)
+			}
+		}
+	}
+	return scrapeErr
+}
+
+// sumByCollection takes the last value of each series and sums the values of
+// series sharing the same bucket, scope and collection, like series split by
+// operation.
+func sumByCollection(stats StatsRangeData) map[[3]string]float64 {
+	values := make(map[[3]string]float64)
+	for _, series := range stats.Data {
+		if len(series.Values) == 0 || len(series.Values[len(series.Values)-1]) != 2 {
+			continue
+		}
+		bucket, _ := series.Metric["bucket"].(string)
+		scope, _ := series.Metric["scope"].(string)
+		collection, _ := series.Metric["collection"].(string)
+		if bucket == "" || scope == "" || collection == "" {
+			continue
+		}
+		// Values are given as [timestamp, "value"] pairs.
+		raw, _ := series.Values[len(series.Values)-1][1].(string)
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		values[[3]string{bucket, scope, collection}] += value
+	}
+	return values
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollectionsExporter(t *testing.T) {
+	// Series of the stats API by metric name, for the queries of the exporter.
+	series := map[string]string{
+		"kv_collection_item_count": `[
+			{"metric": {"bucket": "travel sample", "scope": "inventory", "collection": "hotel"}, "values": [[100, "10"], [101, "12"]]},
+			{"metric": {"bucket": "travel sample", "scope": "inventory", "collection": "dropped"}, "values": [[101, "5"]]},
+			{"metric": {"bucket": "deleted", "scope": "_default", "collection": "_default"}, "values": [[101, "5"]]}
+		]`,
+		"kv_collection_ops": `[
+			{"metric": {"bucket": "travel sample", "scope": "inventory", "collection": "hotel", "op": "get"}, "values": [[101, "3"]]},
+			{"metric": {"bucket": "travel sample", "scope": "inventory", "collection": "hotel", "op": "set"}, "values": [[101, "4"]]},
+			{"metric": {"bucket": "travel sample", "scope": "_default", "collection": "_default", "op": "get"}, "values": [[101, "NaN"]]}
+		]`,
+	}
+	var queried []statsQuery
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/pools/default/buckets":
+			w.Write([]byte(`[{"name": "travel sample"}]`))
+		case "/pools/default/buckets/travel%20sample/scopes":
+			w.Write([]byte(`{"uid": "a", "scopes": [
+				{"name": "_default", "collections": [{"name": "_default"}]},
+				{"name": "inventory", "collections": [{"name": "hotel"}]}
+			]}`))
+		case statsRangeRoute:
+			var queries []statsQuery
+			if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			queried = append(queried, queries...)
+			var results []json.RawMessage
+			for _, query := range queries {
+				data, ok := series[query.Metric[0].Value]
+				if !ok {
+					data = "[]"
+				}
+				results = append(results, json.RawMessage(`{"data": `+data+`}`))
+			}
+			json.NewEncoder(w).Encode(results)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	e, err := NewCollectionsExporter(Context{URI: server.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, e)
+	if err != nil {
+		t.Fatalf("Scrape() error = %v", err)
+	}
+
+	hotel := `{bucket="travel sample",collection="hotel",scope="inventory"}`
+	want := map[string]float64{
+		`cb_collections_manifest_uid{bucket="travel sample"}`: 10,
+		"cb_collections_item_count" + hotel:                   12,
+		"cb_collections_ops_per_second" + hotel:               7,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Scrape() exported %v, want %v", values, want)
+	}
+
+	if len(queried) != len(e.queries) {
+		t.Fatalf("Scrape() sent %d queries, want %d", len(queried), len(e.queries))
+	}
+	for _, query := range queried {
+		if query.Metric[0].Value == "kv_collection_ops" && !reflect.DeepEqual(query.ApplyFunctions, []string{"irate"}) {
+			t.Errorf("Scrape() queried kv_collection_ops with functions %v, want irate", query.ApplyFunctions)
+		}
+		if query.NodesAggregation != "sum" || !query.AlignTimestamps {
+			t.Errorf("Scrape() sent query %+v, want stats summed over nodes with aligned timestamps", query)
+		}
+	}
+}
+
+func TestNewCollectionsExporter(t *testing.T) {
+	e, err := NewCollectionsExporter(Context{})
+	if err != nil {
+		t.Fatalf("NewCollectionsExporter() error = %v", err)
+	}
+	if len(e.queries) == 0 || len(e.queries) != len(e.metrics) {
+		t.Errorf("NewCollectionsExporter() has %d queries for %d metrics", len(e.queries), len(e.metrics))
+	}
+}
@@ -6,17 +6,26 @@ package collector
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/blakelead/couchbase_exporter/metrics"
+
 	p "github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
@@ -24,51 +33,256 @@ import (
 // Metrics is a structure that describes the metrics files
 // that hold  all metrics  informations used  for scraping
 type Metrics struct {
-	Name  string `json:"name"`
-	Route string `json:"route"`
-	List  []struct {
-		Name        string   `json:"name"`
-		ID          string   `json:"id"`
-		Description string   `json:"description"`
-		Labels      []string `json:"labels"`
-	} `json:"list"`
+	Name  string             `json:"name"`
+	Route string             `json:"route"`
+	List  []MetricDefinition `json:"list"`
+}
+
+// MetricDefinition describes a metric of a metrics file. Values are multiplied
+// by Scale when it is set, and string values are converted with Enum when it is set.
+// Route is set for metrics read from another route than the one of their file.
+// Range is the query of the metric in the stats API of Couchbase 7, used by bucket stats.
+// MinVersion and MaxVersion limit the metric to the versions of Couchbase it exists in.
+type MetricDefinition struct {
+	Name        string             `json:"name"`
+	ID          string             `json:"id"`
+	Description string             `json:"description"`
+	Type        string             `json:"type"`
+	Labels      []string           `json:"labels"`
+	Scale       float64            `json:"scale"`
+	Unit        string             `json:"unit"`
+	Enum        map[string]float64 `json:"enum"`
+	Route       string             `json:"route"`
+	Range       string             `json:"range"`
+	MinVersion  string             `json:"min_version"`
+	MaxVersion  string             `json:"max_version"`
+}
+
+// valueTypes maps the type of a metric in the metrics files to a Prometheus value type.
+// Metrics without type are gauges.
+var valueTypes = map[string]p.ValueType{
+	"":        p.GaugeValue,
+	"gauge":   p.GaugeValue,
+	"counter": p.CounterValue,
+	"untyped": p.UntypedValue,
+}
+
+// routeMetrics creates the descriptors of the metrics of m read from route, by
+// ID. Metrics without route are read from the route of m.
+func routeMetrics(c Context, m Metrics, route string) map[string]typedDesc {
+	metrics := make(map[string]typedDesc)
+	for _, metric := range m.List {
+		if metric.Route != route && (metric.Route != "" || route != m.Route) {
+			continue
+		}
+		fqName := p.BuildFQName("cb", m.Name, metric.Name)
+		metrics[metric.ID] = newTypedDesc(c, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
+	}
+	return metrics
+}
+
+// typedDesc is a Prometheus descriptor along with the value type
+// of the metric and the transformations of its values.
+type typedDesc struct {
+	desc      *p.Desc
+	valueType p.ValueType
+	scale     float64
+	enum      map[string]float64
+
+	// window is set when the minimum, maximum and average of the samples
+	// of the metric are exported along with its last sample.
+	window *sampleWindow
+
+	// versions is set when the metric only exists in some versions of Couchbase.
+	versions *versionRange
+}
+
+// newTypedDesc creates a typedDesc from a metric definition of the metrics files.
+func newTypedDesc(c Context, desc *p.Desc, metric MetricDefinition) typedDesc {
+	scale := metric.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return typedDesc{desc: desc, valueType: valueTypes[metric.Type], scale: scale, enum: metric.Enum, versions: newVersionRange(metric, c.cluster)}
+}
+
+// value converts a value read from Couchbase to the value of the metric. Booleans
+// are converted to 1 or 0, strings are converted with the enum of the metric or
+// parsed as numbers or durations in seconds, and arrays and objects are counted.
+// It returns false if the value can't be converted, or if the metric doesn't exist
+// in the version of the cluster.
+func (d typedDesc) value(raw interface{}) (float64, bool) {
+	if !d.versions.supported() {
+		return 0, false
+	}
+	switch raw := raw.(type) {
+	case float64:
+		return raw * d.scale, true
+	case bool:
+		if raw {
+			return 1, true
+		}
+		return 0, true
+	case []interface{}:
+		return float64(len(raw)), true
+	case map[string]interface{}:
+		return float64(len(raw)), true
+	case string:
+		if d.enum != nil {
+			v, ok := d.enum[raw]
+			return v, ok
+		}
+		if v, err := strconv.ParseFloat(raw, 64); err == nil {
+			return v * d.scale, true
+		}
+		if v, err := time.ParseDuration(raw); err == nil {
+			return v.Seconds() * d.scale, true
+		}
+	}
+	return 0, false
+}
+
+// mustNewConstMetric creates a constant metric with the value type of the descriptor.
+func (d typedDesc) mustNewConstMetric(value float64, labels ...string) p.Metric {
+	return p.MustNewConstMetric(d.desc, d.valueType, value, labels...)
+}
+
+// describe sends the descriptor, and the descriptors of the sample window if any.
+func (d typedDesc) describe(ch chan<- *p.Desc) {
+	ch <- d.desc
+	if d.window != nil {
+		ch <- d.window.min
+		ch <- d.window.max
+		ch <- d.window.avg
+	}
+}
+
+// sampleWindow holds the descriptors of the minimum, maximum and average of a
+// metric over the samples returned by Couchbase stats routes. Couchbase returns
+// one sample per second over the last minute, so that spikes between two scrapes
+// are lost when only the last sample is exported.
+type sampleWindow struct {
+	min *p.Desc
+	max *p.Desc
+	avg *p.Desc
+}
+
+// withSampleWindow returns a copy of d exporting the minimum, maximum and average
+// of its samples as fqName suffixed with _min, _max and _avg. Counters are
+// returned as is, since their last sample already accounts for the window.
+func (d typedDesc) withSampleWindow(fqName, help string, labels []string) typedDesc {
+	if d.valueType == p.CounterValue {
+		return d
+	}
+	d.window = &sampleWindow{
+		min: p.NewDesc(fqName+"_min", help+" (minimum over the sample window)", labels, nil),
+		max: p.NewDesc(fqName+"_max", help+" (maximum over the sample window)", labels, nil),
+		avg: p.NewDesc(fqName+"_avg", help+" (average over the sample window)", labels, nil),
+	}
+	return d
+}
+
+// collectWindow emits the minimum, maximum and average of samples. Samples that
+// can't be converted are left out, and nothing is emitted without samples.
+func (d typedDesc) collectWindow(ch chan<- p.Metric, samples []interface{}, labels ...string) {
+	if d.window == nil {
+		return
+	}
+	var min, max, sum float64
+	var count int
+	for _, sample := range samples {
+		value, ok := d.value(sample)
+		if !ok {
+			continue
+		}
+		if count == 0 || value < min {
+			min = value
+		}
+		if count == 0 || value > max {
+			max = value
+		}
+		sum += value
+		count++
+	}
+	if count == 0 {
+		return
+	}
+	ch <- p.MustNewConstMetric(d.window.min, p.GaugeValue, min, labels...)
+	ch <- p.MustNewConstMetric(d.window.max, p.GaugeValue, max, labels...)
+	ch <- p.MustNewConstMetric(d.window.avg, p.GaugeValue, sum/float64(count), labels...)
 }
 
 // Context is a custom url wrapper with credentials and
 // booleans about which metrics types should be scraped
 type Context struct {
-	URI             string
-	Username        string
-	Password        string
-	Timeout         time.Duration
-	ScrapeCluster   bool
-	ScrapeNode      bool
-	ScrapeBucket    bool
-	ScrapeXDCR      bool
-	TLSEnabled      bool
-	TLSSkipInsecure bool
-	TLSCACert       string
-	TLSClientCert   string
-	TLSClientKey    string
-}
-
-// Exporters structure contains all exporters
-type Exporters struct {
-	Cluster     *ClusterExporter
-	Node        *NodeExporter
-	Bucket      *BucketExporter
-	BucketStats *BucketStatsExporter
-	XDCR        *XDCRExporter
-}
-
-// InitExporters instantiates the Exporters
-func InitExporters(c Context) {
+	URI                 string
+	Username            string
+	Password            string
+	Timeout             time.Duration
+	ScrapeCluster       bool
+	ScrapeNode          bool
+	ScrapeAllNodes      bool
+	ScrapeBucket        bool
+	ScrapeBucketPerNode bool
+	ScrapeXDCR          bool
+	ScrapeQuery         bool
+	ScrapeIndex         bool
+	ScrapeFTS           bool
+	ScrapeEventing      bool
+	ScrapeAnalytics     bool
+	ScrapeCollections   bool
+	ScrapeSampleWindow  bool
+	TLSEnabled          bool
+	TLSSkipInsecure     bool
+	TLSCACert           string
+	TLSClientCert       string
+	TLSClientKey        string
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConcurrency      int
+	RateLimit           float64
+	MetricsDir          string
+	CustomMetrics       []CustomMetrics
+
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Client is shared by all requests made with the context. It is created
+	// by NewCollectors when it is not set.
+	Client *http.Client
+
+	// Limiter spaces out requests made to the cluster. It is created by
+	// NewCollectors from RateLimit when it is not set.
+	Limiter *RateLimiter
+
+	// http records requests made with the context. It is set by NewCollectors.
+	http *httpMetrics
+
+	// cluster holds the version of the cluster. It is set by NewCollectors.
+	cluster *clusterInfo
+}
+
+// NewCollectors instantiates the exporters enabled in the context
+func NewCollectors(c Context) *Collectors {
+	cs := &Collectors{registry: p.NewRegistry()}
+	c.http = newHTTPMetrics(cs.registry)
+	cs.http = c.http
+	if c.Client == nil {
+		c.Client = NewHTTPClient(c)
+	}
+	if c.Limiter == nil {
+		c.Limiter = NewRateLimiter(c.RateLimit)
+	}
+	c.cluster = newClusterInfo(c)
+	cs.cluster = c.cluster
+	cs.registry.MustRegister(describer(c.cluster.describe))
+
 	if c.ScrapeCluster {
 		clusterExporter, err := NewClusterExporter(c)
 		if err != nil {
 			log.Error("Error during creation of cluster exporter. Cluster metrics won't be scraped")
 		} else {
-			p.MustRegister(clusterExporter)
+			cs.mustRegister("cluster", clusterExporter)
 			log.Info("Cluster exporter registered")
 		}
 	}
@@ -77,7 +291,7 @@ func InitExporters(c Context) {
 		if err != nil {
 			log.Error("Error during creation of node exporter. Node metrics won't be scraped")
 		} else {
-			p.MustRegister(nodeExporter)
+			cs.mustRegister("node", nodeExporter)
 			log.Info("Node exporter registered")
 		}
 	}
@@ -86,14 +300,14 @@ func InitExporters(c Context) {
 		if err != nil {
 			log.Error("Error during creation of bucket exporter. Bucket metrics won't be scraped")
 		} else {
-			p.MustRegister(bucketExporter)
+			cs.mustRegister("bucket", bucketExporter)
 			log.Info("Bucket exporter registered")
 		}
 		bucketStatsExporter, err := NewBucketStatsExporter(c)
 		if err != nil {
 			log.Error("Error during creation of bucketstats exporter. Bucket stats metrics won't be scraped")
 		} else {
-			p.MustRegister(bucketStatsExporter)
+			cs.mustRegister("bucketstats", bucketStatsExporter)
 			log.Info("Bucketstats exporter registered")
 		}
 	}
@@ -102,56 +316,203 @@ func InitExporters(c Context) {
 		if err != nil {
 			log.Error("Error during creation of XDCR exporter. XDCR metrics won't be scraped")
 		} else {
-			p.MustRegister(xdcrExporter)
+			cs.mustRegister("xdcr", xdcrExporter)
 			log.Info("XDCR exporter registered")
 		}
 	}
+	if c.ScrapeQuery {
+		queryExporter, err := NewQueryExporter(c)
+		if err != nil {
+			log.Error("Error during creation of query exporter. Query metrics won't be scraped")
+		} else {
+			cs.mustRegister("query", queryExporter)
+			log.Info("Query exporter registered")
+		}
+	}
+	if c.ScrapeIndex {
+		indexExporter, err := NewIndexExporter(c)
+		if err != nil {
+			log.Error("Error during creation of index exporter. Index metrics won't be scraped")
+		} else {
+			cs.mustRegister("index", indexExporter)
+			log.Info("Index exporter registered")
+		}
+	}
+	if c.ScrapeFTS {
+		ftsExporter, err := NewFTSExporter(c)
+		if err != nil {
+			log.Error("Error during creation of FTS exporter. FTS metrics won't be scraped")
+		} else {
+			cs.mustRegister("fts", ftsExporter)
+			log.Info("FTS exporter registered")
+		}
+	}
+	if c.ScrapeEventing {
+		eventingExporter, err := NewEventingExporter(c)
+		if err != nil {
+			log.Error("Error during creation of eventing exporter. Eventing metrics won't be scraped")
+		} else {
+			cs.mustRegister("eventing", eventingExporter)
+			log.Info("Eventing exporter registered")
+		}
+	}
+	if c.ScrapeAnalytics {
+		analyticsExporter, err := NewAnalyticsExporter(c)
+		if err != nil {
+			log.Error("Error during creation of analytics exporter. Analytics metrics won't be scraped")
+		} else {
+			cs.mustRegister("analytics", analyticsExporter)
+			log.Info("Analytics exporter registered")
+		}
+	}
+	if c.ScrapeCollections {
+		collectionsExporter, err := NewCollectionsExporter(c)
+		if err != nil {
+			log.Error("Error during creation of collections exporter. Collections metrics won't be scraped")
+		} else {
+			cs.mustRegister("collections", collectionsExporter)
+			log.Info("Collections exporter registered")
+		}
+	}
+	for _, customMetrics := range c.CustomMetrics {
+		customExporter, err := NewCustomExporter(c, customMetrics)
+		if err != nil {
+			log.Error("Error during creation of custom exporter " + customMetrics.Name + ". Its metrics won't be scraped")
+			continue
+		}
+		// Custom metrics come from the configuration file and may collide with other metrics.
+		err = cs.register("custom_"+customMetrics.Name, customExporter)
+		if err != nil {
+			log.Error("Could not register custom exporter " + customMetrics.Name + ": " + err.Error())
+			continue
+		}
+		log.Info("Custom exporter " + customMetrics.Name + " registered")
+	}
+	return cs
+}
+
+// maxErrorBodyLength is the maximum length of the response body kept in an HTTPStatusError.
+const maxErrorBodyLength = 256
+
+// HTTPStatusError is returned by Fetch and Post when Couchbase responds with a status other than 200.
+type HTTPStatusError struct {
+	Code   int
+	Method string
+	Route  string
+	Body   string
+}
+
+func (e *HTTPStatusError) Error() string {
+	msg := e.Method + " " + e.Route + ": " + strconv.Itoa(e.Code) + " " + http.StatusText(e.Code)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// Fetch is a helper function that fetches data from Couchbase API. Failed requests are
+// retried up to Retries times with an exponential backoff, as long as ctx doesn't expire.
+func Fetch(ctx context.Context, c Context, route string) ([]byte, error) {
+	return request(ctx, c, "GET", route, nil)
+}
+
+// Post is like Fetch but sends payload as JSON to route. It must only be
+// used for requests that don't change the cluster, since they are retried.
+func Post(ctx context.Context, c Context, route string, payload []byte) ([]byte, error) {
+	return request(ctx, c, "POST", route, payload)
+}
+
+// request makes a request to route and retries it on failure.
+func request(ctx context.Context, c Context, method, route string, payload []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := fetchOnce(ctx, c, method, route, payload)
+		if err == nil {
+			return body, nil
+		}
+		if attempt >= c.Retries || !retryable(err) || ctx.Err() != nil {
+			log.Error(err.Error())
+			return []byte{}, err
+		}
+
+		// Retries never overrun the scrape, and are only made if they have
+		// time to complete.
+		backoff := retryBackoff(c.RetryBackoff, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff+minAttemptTimeout+deadlineMargin).After(deadline) {
+			log.Error(err.Error())
+			return []byte{}, err
+		}
+		log.Debug("Retrying ", route, " in ", backoff, " after error: ", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.Error(err.Error())
+			return []byte{}, err
+		}
+	}
 }
 
-// Fetch is a helper function that fetches data from Couchbase API
-func Fetch(c Context, route string) ([]byte, error) {
+// deadlineMargin is left between the end of a request and the deadline of
+// the scrape, so that the response can still be processed.
+const deadlineMargin = 100 * time.Millisecond
+
+// minAttemptTimeout is the shortest timeout a request is retried with.
+const minAttemptTimeout = 250 * time.Millisecond
+
+// fetchOnce makes a single request to route. The request times out after the
+// timeout of the context, or earlier if ctx expires first.
+func fetchOnce(ctx context.Context, c Context, method, route string, payload []byte) ([]byte, error) {
+	if err := c.Limiter.Wait(ctx); err != nil {
+		return []byte{}, err
+	}
 	start := time.Now()
 
-	req, err := http.NewRequest("GET", c.URI+route, nil)
+	if timeout := attemptTimeout(ctx, c.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URI+route, reqBody)
 	if err != nil {
-		log.Error(err.Error())
 		return []byte{}, err
 	}
-
-	tlsClientConfig := &tls.Config{}
-	if c.TLSEnabled {
-		tlsClientConfig, err = createTLSClientConfig(c)
-		if err != nil {
-			log.Error(err)
-		}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	req.SetBasicAuth(c.Username, c.Password)
-	client := http.Client{
-		Timeout: c.Timeout,
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-			TLSClientConfig:   tlsClientConfig,
-		},
+	client := c.Client
+	if client == nil {
+		client = NewHTTPClient(c)
+		defer client.CloseIdleConnections()
 	}
 
+	req.SetBasicAuth(c.Username, c.Password)
 	res, err := client.Do(req)
 
 	if err != nil {
-		log.Error(err.Error())
+		c.http.observe(ctx, route, 0, time.Since(start))
+		// The cluster may be down for an upgrade.
+		c.cluster.failed(c.URI, err)
 		return []byte{}, err
 	}
 
+	c.http.observe(ctx, route, res.StatusCode, time.Since(start))
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		log.Error(req.Method + " " + req.URL.Path + ": " + res.Status)
-		return []byte{}, err
+		// Couchbase explains most errors in the body, like a missing permission.
+		excerpt, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodyLength))
+		return []byte{}, &HTTPStatusError{Code: res.StatusCode, Method: method, Route: route, Body: strings.TrimSpace(string(excerpt))}
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Error(err.Error())
 		return []byte{}, err
 	}
 
@@ -160,110 +521,455 @@ func Fetch(c Context, route string) ([]byte, error) {
 	return body, nil
 }
 
-// MultiFetch is like Fetch but makes multiple requests concurrently
-func MultiFetch(c Context, routes []string) map[string][]byte {
-	ch := make(chan struct {
-		route string
-		body  []byte
-	}, len(routes))
+// attemptTimeout returns the timeout of a request: the timeout of the
+// context, shortened to end deadlineMargin before the deadline of ctx.
+// It returns 0 if the request has no timeout.
+func attemptTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	left := time.Until(deadline) - deadlineMargin
+	if left <= 0 {
+		// Too late to leave a margin: the request ends with ctx.
+		return 0
+	}
+	if timeout <= 0 || left < timeout {
+		return left
+	}
+	return timeout
+}
 
-	var wg sync.WaitGroup
-	for _, route := range routes {
-		wg.Add(1)
-		go func(route string) {
-			defer wg.Done()
-			body, err := Fetch(c, route)
-			if err != nil {
-				return
-			}
-			ch <- struct {
-				route string
-				body  []byte
-			}{route, body}
-		}(route)
+// retryable tells whether a failed request is worth retrying: requests that
+// got no response, and requests that failed on the side of the server.
+func retryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
 	}
+	return true
+}
 
-	go func() {
-		defer close(ch)
-		wg.Wait()
-	}()
+// retryBackoff returns the time to wait before the retry following attempt. It doubles
+// with each attempt and is randomized so that retries of concurrent requests spread out.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := base << uint(attempt)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
 
-	bodies := make(map[string][]byte, len(ch))
-	for b := range ch {
-		bodies[b.route] = b.body
+// RateLimiter spaces out requests so that no more than a given number
+// of requests per second are made. A nil RateLimiter doesn't wait.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate requests per second.
+// It returns nil if rate is not positive, meaning that requests are not limited.
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
 	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
 
-	return bodies
+// Wait blocks until the next request is allowed, or until ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// GetMetricsFromFile checks if metric file exist and convert it to Metrics structure
-func GetMetricsFromFile(metricType string) (Metrics, error) {
-	absPath, err := os.Executable()
-	if err != nil {
-		log.Error("An unknown error occurred: ", err)
-		return Metrics{}, err
+// NewHTTPClient creates a client for the connection details of the context. The client
+// keeps connections alive between requests, so it should be created once and shared
+// through the Client field of the context rather than created for each request.
+func NewHTTPClient(c Context) *http.Client {
+	tlsClientConfig := &tls.Config{}
+	if c.TLSEnabled {
+		var err error
+		tlsClientConfig, err = createTLSClientConfig(c)
+		if err != nil {
+			log.Error(err)
+			tlsClientConfig = &tls.Config{}
+		}
 	}
 
-	filename := filepath.Dir(absPath) + string(os.PathSeparator) + "metrics" + string(os.PathSeparator) + metricType + ".json"
-	if _, err := os.Stat(filename); err != nil {
-		log.Error("Could not find metrics file ", filename)
-		return Metrics{}, err
+	return &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   c.Timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsClientConfig,
+			TLSHandshakeTimeout: c.Timeout,
+			MaxIdleConns:        c.MaxIdleConns,
+			MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+			// HTTP/2 is used when Couchbase supports it, which requires TLS.
+			ForceAttemptHTTP2: true,
+		},
 	}
+}
 
-	rawMetrics, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Error("Could not read file ", filename)
-		return Metrics{}, err
+// MultiFetch is like Fetch but makes multiple requests concurrently, with
+// at most MaxConcurrency requests at a time. Other requests are queued, and
+// dropped once ctx is done. Routes that could not be fetched are returned
+// with their error.
+func MultiFetch(ctx context.Context, c Context, routes []string) (map[string][]byte, map[string]error) {
+	requests := make([]fetchRequest, len(routes))
+	for i, route := range routes {
+		requests[i] = fetchRequest{context: c, route: route}
+	}
+	results := fetchAll(ctx, c.MaxConcurrency, requests)
+
+	bodies := make(map[string][]byte, len(routes))
+	errs := make(map[string]error)
+	for i, result := range results {
+		if result.err != nil {
+			errs[routes[i]] = result.err
+			continue
+		}
+		bodies[routes[i]] = result.body
+	}
+	return bodies, errs
+}
+
+// fetchNodes is like MultiFetch but fetches routes from every node running a
+// service, with at most MaxConcurrency requests at a time across all nodes.
+// Bodies and errors are returned in the order of nodes.
+func fetchNodes(ctx context.Context, c Context, nodes []serviceNode, routes ...string) ([]map[string][]byte, []map[string]error) {
+	var requests []fetchRequest
+	for _, node := range nodes {
+		for _, route := range routes {
+			requests = append(requests, fetchRequest{context: node.context, route: route})
+		}
+	}
+	results := fetchAll(ctx, c.MaxConcurrency, requests)
+
+	bodies := make([]map[string][]byte, len(nodes))
+	errs := make([]map[string]error, len(nodes))
+	for i := range nodes {
+		bodies[i] = make(map[string][]byte, len(routes))
+		errs[i] = make(map[string]error)
+		for j, route := range routes {
+			result := results[i*len(routes)+j]
+			if result.err != nil {
+				errs[i][route] = result.err
+				continue
+			}
+			bodies[i][route] = result.body
+		}
+	}
+	return bodies, errs
+}
+
+// fetchRequest is a request to a route of the cluster or of one of its nodes.
+type fetchRequest struct {
+	context Context
+	route   string
+}
+
+// fetchResult is the response to a fetchRequest.
+type fetchResult struct {
+	body []byte
+	err  error
+}
+
+// fetchAll makes requests concurrently, with at most maxConcurrency requests
+// at a time. Other requests are queued, and dropped once ctx is done. Results
+// are returned in the order of requests.
+func fetchAll(ctx context.Context, maxConcurrency int, requests []fetchRequest) []fetchResult {
+	results := make([]fetchResult, len(requests))
+
+	workers := maxConcurrency
+	if workers <= 0 || workers > len(requests) {
+		workers = len(requests)
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i].body, results[i].err = Fetch(ctx, requests[i].context, requests[i].route)
+			}
+		}()
+	}
+
+	for i := range requests {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			results[i].err = ctx.Err()
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// GetMetricsFromFile loads the metrics file of the given type and converts it to Metrics structure.
+// The file is read from the metrics directory of the context if it exists there, otherwise the
+// definition compiled into the binary is used.
+func GetMetricsFromFile(c Context, metricType string) (Metrics, error) {
+	filename := metricType + ".json"
+	source := "embedded " + filename
+
+	var rawMetrics []byte
+	var err error
+	if c.MetricsDir != "" {
+		path := filepath.Join(c.MetricsDir, filename)
+		rawMetrics, err = ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("Could not read file ", path)
+			return Metrics{}, err
+		}
+		source = path
+	}
+	if rawMetrics == nil {
+		rawMetrics, err = metrics.Files.ReadFile(filename)
+		if err != nil {
+			log.Error("Could not find metrics definition ", filename)
+			return Metrics{}, err
+		}
+		source = "embedded " + filename
 	}
 
 	var metrics Metrics
 	err = json.Unmarshal(rawMetrics, &metrics)
 	if err != nil {
-		log.Error("Could not unmarshal file ", filename)
+		log.Error("Could not unmarshal ", source)
+		return Metrics{}, err
+	}
+	err = validateMetrics(metrics.List, source)
+	if err != nil {
 		return Metrics{}, err
 	}
 
-	log.Debug(filename, " loaded")
+	log.Info(metricType, " metrics loaded from ", source)
 
 	return metrics, nil
 }
 
-// FlattenStruct flattens structure into a Go map
-func FlattenStruct(obj interface{}, def ...string) map[string]interface{} {
-	fields := make(map[string]interface{}, 0)
-	objValue := reflect.ValueOf(obj)
-	objType := reflect.TypeOf(obj)
-
-	var prefix string
-	if len(def) > 0 {
-		prefix = def[0]
+// validateMetrics checks the type, id, name, unit and versions of metric definitions read from source.
+func validateMetrics(list []MetricDefinition, source string) error {
+	for _, metric := range list {
+		if _, ok := valueTypes[metric.Type]; !ok {
+			log.Error("Unknown type ", metric.Type, " of metric ", metric.ID, " in ", source)
+			return fmt.Errorf("unknown metric type %q", metric.Type)
+		}
+		if _, err := parsePath(metric.ID); err != nil {
+			log.Error("Invalid id ", metric.ID, " in ", source)
+			return err
+		}
+		// Counters are suffixed with _total after the unit.
+		if metric.Type == "counter" && !strings.HasSuffix(metric.Name, "_total") {
+			log.Error("Name of counter ", metric.ID, " in ", source, " should end with _total")
+			return fmt.Errorf("counter name %q does not end with _total", metric.Name)
+		}
+		if metric.Type != "counter" && strings.HasSuffix(metric.Name, "_total") {
+			log.Error("Name of metric ", metric.ID, " in ", source, " ends with _total but it is not a counter")
+			return fmt.Errorf("metric name %q ends with _total but type is %q", metric.Name, metric.Type)
+		}
+		name := strings.TrimSuffix(metric.Name, "_total")
+		if metric.Unit != "" && !strings.HasSuffix(name, "_"+metric.Unit) {
+			log.Error("Name of metric ", metric.ID, " in ", source, " should end with unit ", metric.Unit)
+			return fmt.Errorf("metric name %q does not match unit %q", metric.Name, metric.Unit)
+		}
+		for _, v := range []string{metric.MinVersion, metric.MaxVersion} {
+			if v == "" {
+				continue
+			}
+			if _, _, err := parseVersion(v); err != nil {
+				log.Error("Invalid version ", v, " of metric ", metric.ID, " in ", source)
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	for i := 0; i < objType.NumField(); i++ {
-		attrField := objValue.Type().Field(i)
-		valueField := objValue.Field(i)
-		var key bytes.Buffer
-		key.WriteString(prefix + attrField.Name)
+// pathSegment is an element of a JSON path: either the key of an object or the
+// index of an array. Negative indexes start from the end of the array.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
 
-		switch valueField.Kind() {
-		case reflect.Struct:
-			tmpMap := FlattenStruct(valueField.Interface(), attrField.Name+".")
-			for k, v := range tmpMap {
-				fields[k] = v
+// parsePath splits a JSON path like "op.samples.cmd_get[-1]" into segments.
+// Keys containing dots or brackets are quoted: "vitals['request.active.count']".
+func parsePath(path string) ([]pathSegment, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var segments []pathSegment
+	for len(path) > 0 {
+		switch {
+		case path[0] == '.':
+			path = path[1:]
+			if len(path) == 0 || path[0] == '.' || path[0] == '[' {
+				return nil, fmt.Errorf("empty key in JSON path")
 			}
-		case reflect.Float64:
-			fields[key.String()] = valueField.Float()
-		case reflect.String:
-			fields[key.String()] = valueField.String()
-		case reflect.Int64:
-			fields[key.String()] = valueField.Int()
-		case reflect.Bool:
-			fields[key.String()] = valueField.Bool()
+		case path[0] == '[' && len(path) > 1 && (path[1] == '\'' || path[1] == '"'):
+			end := strings.IndexByte(path[2:], path[1])
+			if end < 0 || len(path) < end+4 || path[end+3] != ']' {
+				return nil, fmt.Errorf("unterminated quoted key in JSON path")
+			}
+			segments = append(segments, pathSegment{key: path[2 : end+2]})
+			path = path[end+4:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSON path")
+			}
+			index, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index in JSON path: %v", err)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+			path = path[end+1:]
 		default:
-			fields[key.String()] = valueField.Interface()
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			segments = append(segments, pathSegment{key: path[:end]})
+			path = path[end:]
+		}
+	}
+	return segments, nil
+}
+
+// JSONPath returns the value found at path in a document decoded from JSON
+// into an interface{}, and false if the path can't be followed.
+func JSONPath(doc interface{}, path string) (interface{}, bool) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, false
+	}
+	value := doc
+	for _, segment := range segments {
+		if segment.isIndex {
+			array, ok := value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			index := segment.index
+			if index < 0 {
+				index += len(array)
+			}
+			if index < 0 || index >= len(array) {
+				return nil, false
+			}
+			value = array[index]
+		} else {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			value, ok = object[segment.key]
+			if !ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+// collectPaths emits each metric with the value found at its ID, used as a
+// JSON path in doc, and the given label values. Metrics with a sample window
+// also emit the window of the array their ID selects the last element of.
+func collectPaths(ch chan<- p.Metric, metrics map[string]typedDesc, doc interface{}, labels ...string) {
+	for path, metric := range metrics {
+		raw, ok := JSONPath(doc, path)
+		if !ok {
+			continue
+		}
+		if value, ok := metric.value(raw); ok {
+			ch <- metric.mustNewConstMetric(value, labels...)
+		}
+		if metric.window != nil {
+			samples, _ := JSONPath(doc, strings.TrimSuffix(path, lastSample))
+			if samples, ok := samples.([]interface{}); ok {
+				metric.collectWindow(ch, samples, labels...)
+			}
+		}
+	}
+}
+
+// lastSample ends the ID of metrics reading the last sample of a stats array.
+const lastSample = "[-1]"
+
+// serviceNode is a node of the cluster running a given service. Its
+// context points at the REST port of that service instead of ns_server.
+type serviceNode struct {
+	hostname string
+	context  Context
+}
+
+// serviceNodes lists the nodes running service (as named in the services
+// list of /pools/default) with a context pointing at port, or tlsPort if
+// the cluster is reached through https.
+func serviceNodes(ctx context.Context, c Context, service string, port, tlsPort string) ([]serviceNode, error) {
+	body, err := Fetch(ctx, c, "/pools/default")
+	if err != nil {
+		return nil, err
+	}
+	var cluster struct {
+		Nodes []struct {
+			Hostname string   `json:"hostname"`
+			Services []string `json:"services"`
+		} `json:"nodes"`
+	}
+	err = json.Unmarshal(body, &cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http://"
+	if strings.HasPrefix(c.URI, "https://") {
+		scheme, port = "https://", tlsPort
+	}
+
+	var nodes []serviceNode
+	for _, node := range cluster.Nodes {
+		for _, s := range node.Services {
+			if s != service {
+				continue
+			}
+			host, _, err := net.SplitHostPort(node.Hostname)
+			if err != nil {
+				host = node.Hostname
+			}
+			nodeContext := c
+			nodeContext.URI = scheme + net.JoinHostPort(host, port)
+			nodes = append(nodes, serviceNode{hostname: node.Hostname, context: nodeContext})
 		}
 	}
-	return fields
+	return nodes, nil
 }
 
 // createTLSClientConfig loads certificates and create TLS config
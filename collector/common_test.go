@@ -0,0 +1,682 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blakelead/couchbase_exporter/metrics"
+	p "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// serveRoutes starts a server responding to each route with its body, and
+// with 404 to other routes. Query strings are part of routes.
+func serveRoutes(routes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+// scrapeMetrics scrapes s and returns the values of its metrics by name and
+// labels, like cb_node_status{hostname="h",node="n"}, with sorted labels.
+func scrapeMetrics(t *testing.T, s scraper) (map[string]float64, error) {
+	t.Helper()
+	var err error
+	ch := make(chan p.Metric)
+	go func() {
+		defer close(ch)
+		err = s.Scrape(context.Background(), ch)
+	}()
+
+	values := make(map[string]float64)
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, label := range m.Label {
+			labels = append(labels, label.GetName()+"="+strconv.Quote(label.GetValue()))
+		}
+		sort.Strings(labels)
+		name := metricName(metric.Desc())
+		if len(labels) > 0 {
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+		switch {
+		case m.Gauge != nil:
+			values[name] = m.Gauge.GetValue()
+		case m.Counter != nil:
+			values[name] = m.Counter.GetValue()
+		case m.Untyped != nil:
+			values[name] = m.Untyped.GetValue()
+		}
+	}
+	return values, err
+}
+
+// scrapeFunc adapts a function scraping part of the metrics of an exporter to a scraper.
+type scrapeFunc func(ctx context.Context, ch chan<- p.Metric) error
+
+func (f scrapeFunc) Describe(ch chan<- *p.Desc) {}
+
+func (f scrapeFunc) Scrape(ctx context.Context, ch chan<- p.Metric) error { return f(ctx, ch) }
+
+// metricName returns the name of the metrics described by desc.
+func metricName(desc *p.Desc) string {
+	name := strings.TrimPrefix(desc.String(), `Desc{fqName: "`)
+	return name[:strings.IndexByte(name, '"')]
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		segments []pathSegment
+		err      bool
+	}{
+		{path: "uptime", segments: []pathSegment{{key: "uptime"}}},
+		{path: "$.uptime", segments: []pathSegment{{key: "uptime"}}},
+		{path: "$", segments: nil},
+		{path: "op.samples.cmd_get[-1]", segments: []pathSegment{{key: "op"}, {key: "samples"}, {key: "cmd_get"}, {index: -1, isIndex: true}}},
+		{path: "nodes[0].hostname", segments: []pathSegment{{key: "nodes"}, {index: 0, isIndex: true}, {key: "hostname"}}},
+		{path: "vitals['request.active.count']", segments: []pathSegment{{key: "vitals"}, {key: "request.active.count"}}},
+		{path: `vitals["request.active.count"].value`, segments: []pathSegment{{key: "vitals"}, {key: "request.active.count"}, {key: "value"}}},
+		{path: "a..b", err: true},
+		{path: "a.", err: true},
+		{path: "a.[0]", err: true},
+		{path: "a['b", err: true},
+		{path: "a['b'", err: true},
+		{path: "a[0", err: true},
+		{path: "a[x]", err: true},
+	}
+	for _, test := range tests {
+		segments, err := parsePath(test.path)
+		if (err != nil) != test.err {
+			t.Errorf("parsePath(%q) error = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(segments, test.segments) {
+			t.Errorf("parsePath(%q) = %+v, want %+v", test.path, segments, test.segments)
+		}
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{
+		"uptime": "3600",
+		"op": {"samples": {"cmd_get": [1, 2, 3]}},
+		"vitals": {"request.active.count": 4},
+		"nodes": [{"hostname": "10.0.0.1:8091"}]
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		value interface{}
+		ok    bool
+	}{
+		{path: "uptime", value: "3600", ok: true},
+		{path: "op.samples.cmd_get[0]", value: 1.0, ok: true},
+		{path: "op.samples.cmd_get[-1]", value: 3.0, ok: true},
+		{path: "op.samples.cmd_get[-3]", value: 1.0, ok: true},
+		{path: "vitals['request.active.count']", value: 4.0, ok: true},
+		{path: "nodes[0].hostname", value: "10.0.0.1:8091", ok: true},
+		{path: "$", value: doc, ok: true},
+		{path: "op.samples.cmd_get[3]"},
+		{path: "op.samples.cmd_get[-4]"},
+		{path: "op.samples.cmd_set[-1]"},
+		{path: "uptime.seconds"},
+		{path: "nodes.hostname"},
+		{path: "op[0]"},
+		{path: "a..b"},
+	}
+	for _, test := range tests {
+		value, ok := JSONPath(doc, test.path)
+		if ok != test.ok {
+			t.Errorf("JSONPath(%q) ok = %v, want %v", test.path, ok, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("JSONPath(%q) = %v, want %v", test.path, value, test.value)
+		}
+	}
+}
+
+func TestTypedDescValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric MetricDefinition
+		raw    interface{}
+		value  float64
+		ok     bool
+	}{
+		{name: "number", raw: 42.0, value: 42, ok: true},
+		{name: "scaled number", metric: MetricDefinition{Scale: 0.001}, raw: 1500.0, value: 1.5, ok: true},
+		{name: "true", raw: true, value: 1, ok: true},
+		{name: "false", raw: false, value: 0, ok: true},
+		{name: "array", raw: []interface{}{1.0, 2.0}, value: 2, ok: true},
+		{name: "object", raw: map[string]interface{}{"a": 1.0}, value: 1, ok: true},
+		{name: "numeric string", raw: "3600", value: 3600, ok: true},
+		{name: "scaled numeric string", metric: MetricDefinition{Scale: 1e-09}, raw: "2000000000", value: 2, ok: true},
+		{name: "duration", raw: "1.5ms", value: 0.0015, ok: true},
+		{name: "scaled duration", metric: MetricDefinition{Scale: 1000}, raw: "1.5ms", value: 1.5, ok: true},
+		{name: "enum", metric: MetricDefinition{Enum: map[string]float64{"none": 0, "running": 1}}, raw: "running", value: 1, ok: true},
+		{name: "enum value is not scaled", metric: MetricDefinition{Scale: 10, Enum: map[string]float64{"running": 1}}, raw: "running", value: 1, ok: true},
+		{name: "unknown enum value", metric: MetricDefinition{Enum: map[string]float64{"none": 0, "running": 1}}, raw: "stopped"},
+		{name: "enum of a numeric string", metric: MetricDefinition{Enum: map[string]float64{"none": 0}}, raw: "1"},
+		{name: "string", raw: "enterprise"},
+		{name: "null", raw: nil},
+	}
+	for _, test := range tests {
+		value, ok := newTypedDesc(Context{}, nil, test.metric).value(test.raw)
+		if ok != test.ok || value != test.value {
+			t.Errorf("%s: value(%v) = %v, %v, want %v, %v", test.name, test.raw, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestSampleWindow(t *testing.T) {
+	labels := []string{"bucket"}
+	newDesc := func(name, valueType string) typedDesc {
+		metric := MetricDefinition{Name: name, ID: "op.samples." + name + "[-1]", Type: valueType, Labels: labels, Scale: 0.001}
+		fqName := "cb_bucketstats_" + name
+		return newTypedDesc(Context{}, p.NewDesc(fqName, "help", labels, nil), metric).withSampleWindow(fqName, "help", labels)
+	}
+	if desc := newDesc("cmd_get_total", "counter"); desc.window != nil {
+		t.Errorf("withSampleWindow() added a window to a counter")
+	}
+	metrics := map[string]typedDesc{
+		"op.samples.disk_write_queue[-1]": newDesc("disk_write_queue", "gauge"),
+		"op.samples.mem_used[-1]":         newDesc("mem_used", "gauge"),
+		"op.samples.cmd_get_total[-1]":    newDesc("cmd_get_total", "counter"),
+	}
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{"op": {"samples": {
+		"disk_write_queue": [1000, "invalid", 5000, 3000],
+		"mem_used": [],
+		"cmd_get_total": [1000, 2000]
+	}}}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		collectPaths(ch, metrics, doc, "travel")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := `{bucket="travel"}`
+	want := map[string]float64{
+		"cb_bucketstats_disk_write_queue" + bucket:     3,
+		"cb_bucketstats_disk_write_queue_min" + bucket: 1,
+		"cb_bucketstats_disk_write_queue_max" + bucket: 5,
+		"cb_bucketstats_disk_write_queue_avg" + bucket: 3,
+		"cb_bucketstats_cmd_get_total" + bucket:        2,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("collectPaths() exported %v, want %v", values, want)
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	m := Metrics{Name: "index", Route: "/stats", List: []MetricDefinition{
+		{Name: "items_count", ID: "items_count"},
+		{Name: "disk_size_bytes", ID: "disk_size", Route: "/stats"},
+		{Name: "status", ID: "status", Route: "/indexStatus"},
+	}}
+	tests := []struct {
+		route string
+		ids   []string
+	}{
+		{route: "/stats", ids: []string{"disk_size", "items_count"}},
+		{route: "/indexStatus", ids: []string{"status"}},
+		{route: "/settings/indexes", ids: nil},
+	}
+	for _, test := range tests {
+		var ids []string
+		for id := range routeMetrics(Context{}, m, test.route) {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("routeMetrics(%s) = %v, want %v", test.route, ids, test.ids)
+		}
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric MetricDefinition
+		err    bool
+	}{
+		{name: "gauge", metric: MetricDefinition{Name: "items", ID: "items"}},
+		{name: "counter", metric: MetricDefinition{Name: "gets_total", ID: "gets", Type: "counter"}},
+		{name: "counter with unit", metric: MetricDefinition{Name: "gc_time_seconds_total", ID: "gc_time", Type: "counter", Unit: "seconds"}},
+		{name: "counter without _total", metric: MetricDefinition{Name: "gets", ID: "gets", Type: "counter"}, err: true},
+		{name: "gauge with _total", metric: MetricDefinition{Name: "mem_total", ID: "mem_total", Type: "gauge"}, err: true},
+		{name: "default type with _total", metric: MetricDefinition{Name: "mem_total", ID: "mem_total"}, err: true},
+		{name: "untyped with _total", metric: MetricDefinition{Name: "mem_total", ID: "mem_total", Type: "untyped"}, err: true},
+		{name: "unknown type", metric: MetricDefinition{Name: "items", ID: "items", Type: "histogram"}, err: true},
+		{name: "invalid id", metric: MetricDefinition{Name: "items", ID: "items["}, err: true},
+		{name: "unit missing from name", metric: MetricDefinition{Name: "heap_used", ID: "heap_used", Unit: "bytes"}, err: true},
+		{name: "invalid version", metric: MetricDefinition{Name: "items", ID: "items", MinVersion: "7.x"}, err: true},
+	}
+	for _, test := range tests {
+		err := validateMetrics([]MetricDefinition{test.metric}, "test")
+		if (err != nil) != test.err {
+			t.Errorf("%s: validateMetrics() error = %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestEmbeddedMetrics(t *testing.T) {
+	files, err := metrics.Files.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		metricType := strings.TrimSuffix(file.Name(), ".json")
+		if _, err := GetMetricsFromFile(Context{}, metricType); err != nil {
+			t.Errorf("GetMetricsFromFile(%s) error = %v", metricType, err)
+		}
+	}
+}
+
+func TestGetMetricsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cluster.json": `{"name": "cluster", "route": "/pools/default", "list": [{"name": "ram_total_bytes", "id": "storageTotals.ram.total"}]}`,
+		"bucket.json":  `{"name": "bucket", "list": [`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := Context{MetricsDir: dir}
+
+	cluster, err := GetMetricsFromFile(c, "cluster")
+	if err != nil || len(cluster.List) != 1 {
+		t.Errorf("GetMetricsFromFile(cluster) = %d metrics, %v, want the single metric of the metrics directory", len(cluster.List), err)
+	}
+	node, err := GetMetricsFromFile(c, "node")
+	if err != nil || len(node.List) == 0 {
+		t.Errorf("GetMetricsFromFile(node) = %d metrics, %v, want the embedded metrics", len(node.List), err)
+	}
+	if _, err := GetMetricsFromFile(c, "bucket"); err == nil {
+		t.Errorf("GetMetricsFromFile(bucket) of an invalid file returned no error")
+	}
+	if _, err := GetMetricsFromFile(c, "unknown"); err == nil {
+		t.Errorf("GetMetricsFromFile(unknown) returned no error")
+	}
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools/default/buckets":
+			http.Error(w, `{"message": "Forbidden. User needs one of the following permissions"}`, http.StatusForbidden)
+		case "/settings/autoFailover":
+			w.WriteHeader(http.StatusNotFound)
+		case "/pools/default/stats/range":
+			http.Error(w, strings.Repeat("x", 2*maxErrorBodyLength), http.StatusBadRequest)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+	c := Context{URI: server.URL, Timeout: time.Second}
+
+	tests := []struct {
+		route   string
+		code    int
+		message string
+	}{
+		{route: "/pools/default/buckets", code: 403, message: `GET /pools/default/buckets: 403 Forbidden: {"message": "Forbidden. User needs one of the following permissions"}`},
+		{route: "/settings/autoFailover", code: 404, message: "GET /settings/autoFailover: 404 Not Found"},
+		{route: "/pools/default/stats/range", code: 400, message: "GET /pools/default/stats/range: 400 Bad Request: " + strings.Repeat("x", maxErrorBodyLength)},
+		{route: "/pools"},
+	}
+	for _, test := range tests {
+		_, err := Fetch(context.Background(), c, test.route)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("Fetch(%s) error = %v", test.route, err)
+			}
+			continue
+		}
+		var statusErr *HTTPStatusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("Fetch(%s) error = %v, want an HTTPStatusError", test.route, err)
+			continue
+		}
+		if statusErr.Code != test.code || statusErr.Route != test.route || err.Error() != test.message {
+			t.Errorf("Fetch(%s) error = %q (code %d), want %q (code %d)", test.route, err, statusErr.Code, test.message, test.code)
+		}
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	c := Context{URI: server.URL, Timeout: time.Second, MaxIdleConns: 10, MaxIdleConnsPerHost: 2}
+	c.Client = NewHTTPClient(c)
+	transport := c.Client.Transport.(*http.Transport)
+	if transport.Proxy != nil {
+		t.Errorf("NewHTTPClient() reads proxy settings from the environment")
+	}
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 2 {
+		t.Errorf("NewHTTPClient() keeps %d idle connections and %d per host, want 10 and 2", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := Fetch(context.Background(), c, "/pools"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("5 sequential requests opened %d connections, want 1", n)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{base: 100 * time.Millisecond, attempt: 0, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{base: 100 * time.Millisecond, attempt: 1, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{base: 100 * time.Millisecond, attempt: 3, min: 400 * time.Millisecond, max: 800 * time.Millisecond},
+		{base: 0, attempt: 2, min: 0, max: 0},
+		{base: time.Second, attempt: 64, min: 0, max: 0},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := retryBackoff(test.base, test.attempt)
+			if backoff < test.min || backoff > test.max {
+				t.Errorf("retryBackoff(%v, %d) = %v, want between %v and %v", test.base, test.attempt, backoff, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		timeout  time.Duration
+		min      time.Duration
+		max      time.Duration
+	}{
+		{name: "no deadline", timeout: 10 * time.Second, min: 10 * time.Second, max: 10 * time.Second},
+		{name: "no deadline nor timeout", min: 0, max: 0},
+		{name: "deadline after timeout", deadline: time.Minute, timeout: 10 * time.Second, min: 10 * time.Second, max: 10 * time.Second},
+		{name: "deadline before timeout", deadline: 5 * time.Second, timeout: 10 * time.Second, min: 4 * time.Second, max: 5*time.Second - deadlineMargin},
+		{name: "deadline without timeout", deadline: 5 * time.Second, min: 4 * time.Second, max: 5*time.Second - deadlineMargin},
+		{name: "deadline within margin", deadline: deadlineMargin / 2, timeout: 10 * time.Second, min: 0, max: 0},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.deadline)
+			defer cancel()
+		}
+		timeout := attemptTimeout(ctx, test.timeout)
+		if timeout < test.min || timeout > test.max {
+			t.Errorf("%s: attemptTimeout() = %v, want between %v and %v", test.name, timeout, test.min, test.max)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		retries  int
+		deadline time.Duration
+		requests int32
+		err      bool
+	}{
+		{name: "success", codes: []int{200}, retries: 2, requests: 1},
+		{name: "server error then success", codes: []int{503, 200}, retries: 2, requests: 2},
+		{name: "too many requests then success", codes: []int{429, 200}, retries: 2, requests: 2},
+		{name: "retries exhausted", codes: []int{500, 500, 500, 200}, retries: 2, requests: 3, err: true},
+		{name: "client error", codes: []int{404, 200}, retries: 2, requests: 1, err: true},
+		{name: "no time left to retry", codes: []int{503, 200}, retries: 2, deadline: minAttemptTimeout, requests: 1, err: true},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&requests, 1)
+			w.WriteHeader(test.codes[int(n)-1])
+			w.Write([]byte("{}"))
+		}))
+
+		ctx := context.Background()
+		if test.deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.deadline)
+			defer cancel()
+		}
+		c := Context{URI: server.URL, Timeout: time.Second, Retries: test.retries, RetryBackoff: time.Millisecond}
+		_, err := Fetch(ctx, c, "/pools")
+		if (err != nil) != test.err {
+			t.Errorf("%s: Fetch() error = %v, want error %v", test.name, err, test.err)
+		}
+		if requests != test.requests {
+			t.Errorf("%s: Fetch() made %d requests, want %d", test.name, requests, test.requests)
+		}
+		server.Close()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		requests int
+		min      time.Duration
+	}{
+		{name: "unlimited", rate: 0, requests: 10, min: 0},
+		{name: "100 per second", rate: 100, requests: 6, min: 50 * time.Millisecond},
+		{name: "20 per second", rate: 20, requests: 3, min: 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		limiter := NewRateLimiter(test.rate)
+		if (limiter == nil) != (test.rate <= 0) {
+			t.Errorf("%s: NewRateLimiter(%v) = %v", test.name, test.rate, limiter)
+		}
+		start := time.Now()
+		for i := 0; i < test.requests; i++ {
+			if err := limiter.Wait(context.Background()); err != nil {
+				t.Errorf("%s: Wait() error = %v", test.name, err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < test.min || elapsed > test.min+time.Second {
+			t.Errorf("%s: %d requests took %v, want at least %v", test.name, test.requests, elapsed, test.min)
+		}
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, limiter := range []*RateLimiter{nil, NewRateLimiter(0.1)} {
+		// The first request of a limiter is allowed right away.
+		limiter.Wait(context.Background())
+		if err := limiter.Wait(ctx); err != context.Canceled {
+			t.Errorf("Wait() with a canceled context error = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func TestMultiFetch(t *testing.T) {
+	tests := []struct {
+		name           string
+		routes         int
+		maxConcurrency int
+		want           int32
+	}{
+		{name: "bounded", routes: 10, maxConcurrency: 2, want: 2},
+		{name: "more workers than routes", routes: 3, maxConcurrency: 10, want: 3},
+		{name: "unbounded", routes: 5, maxConcurrency: 0, want: 5},
+	}
+	for _, test := range tests {
+		var inFlight, maxInFlight int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(r.URL.Path))
+		}))
+
+		routes := []string{"/missing"}
+		for i := 1; i < test.routes; i++ {
+			routes = append(routes, "/route"+strconv.Itoa(i))
+		}
+		c := Context{URI: server.URL, Timeout: time.Second, MaxConcurrency: test.maxConcurrency}
+		bodies, errs := MultiFetch(context.Background(), c, routes)
+
+		if len(bodies) != test.routes-1 || len(errs) != 1 || errs["/missing"] == nil {
+			t.Errorf("%s: MultiFetch() returned %d bodies and errors %v, want %d bodies and an error for /missing", test.name, len(bodies), errs, test.routes-1)
+		}
+		for route, body := range bodies {
+			if string(body) != route {
+				t.Errorf("%s: MultiFetch() body of %s = %q", test.name, route, body)
+			}
+		}
+		if maxInFlight != test.want {
+			t.Errorf("%s: MultiFetch() made %d concurrent requests, want %d", test.name, maxInFlight, test.want)
+		}
+		server.Close()
+	}
+}
+
+func TestFetchNodes(t *testing.T) {
+	var inFlight, maxInFlight int32
+	handler := func(node string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			if node == "b" && r.URL.Path == "/stats" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(node + r.URL.Path))
+		})
+	}
+	var nodes []serviceNode
+	for _, name := range []string{"a", "b", "c"} {
+		server := httptest.NewServer(handler(name))
+		defer server.Close()
+		nodes = append(nodes, serviceNode{hostname: name, context: Context{URI: server.URL, Timeout: time.Second}})
+	}
+
+	bodies, errs := fetchNodes(context.Background(), Context{MaxConcurrency: 4}, nodes, "/vitals", "/stats")
+
+	wantBodies := []map[string][]byte{
+		{"/vitals": []byte("a/vitals"), "/stats": []byte("a/stats")},
+		{"/vitals": []byte("b/vitals")},
+		{"/vitals": []byte("c/vitals"), "/stats": []byte("c/stats")},
+	}
+	if !reflect.DeepEqual(bodies, wantBodies) {
+		t.Errorf("fetchNodes() bodies = %q, want %q", bodies, wantBodies)
+	}
+	if len(errs) != len(nodes) || len(errs[0]) != 0 || errs[1]["/stats"] == nil || len(errs[1]) != 1 || len(errs[2]) != 0 {
+		t.Errorf("fetchNodes() errors = %v, want an error for /stats of node b", errs)
+	}
+	if maxInFlight != 4 {
+		t.Errorf("fetchNodes() made %d concurrent requests, want 4", maxInFlight)
+	}
+}
+
+func TestFetchCanceled(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := Fetch(ctx, Context{URI: server.URL, Timeout: 10 * time.Second, Retries: 3, RetryBackoff: time.Millisecond}, "/pools")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Fetch() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Fetch() returned %v after cancellation", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Fetch() made %d requests, want no retry after cancellation", n)
+	}
+}
+
+func TestMultiFetchCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	routes := []string{"/a", "/b", "/c"}
+	bodies, errs := MultiFetch(ctx, Context{URI: "http://127.0.0.1:1", MaxConcurrency: 1}, routes)
+	if len(bodies) != 0 || len(errs) != len(routes) {
+		t.Errorf("MultiFetch() with a canceled context returned %d bodies and %d errors, want 0 and %d", len(bodies), len(errs), len(routes))
+	}
+}
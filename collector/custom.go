@@ -0,0 +1,303 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// routePlaceholders are the placeholders a custom route can contain. Each one
+// expands over the buckets or the nodes of the cluster, and is added as a label.
+var routePlaceholders = []string{"bucket", "node"}
+
+// CustomMetrics is a set of metrics declared in the configuration file. Its
+// route can contain {bucket} and {node} placeholders.
+type CustomMetrics struct {
+	Name  string
+	Route string
+	List  []CustomMetricDefinition
+}
+
+// CustomMetricDefinition is a metric definition along with the rules to extract
+// its labels. When Each is set, it is the JSON path of an array of the response,
+// and the metric is emitted for each element of the array. ID and LabelPaths are
+// then relative to the element. Labels are given in the order of their names.
+type CustomMetricDefinition struct {
+	MetricDefinition
+	Each       string
+	LabelPaths map[string]string
+}
+
+// CustomExporter encapsulates metrics of a custom set and context.
+type CustomExporter struct {
+	context      Context
+	route        string
+	placeholders []string
+	metrics      []customMetric
+}
+
+// customMetric is a metric of a custom set ready to be collected.
+type customMetric struct {
+	typedDesc
+	name       string
+	id         string
+	each       string
+	labelPaths []string
+	duplicated *sync.Once
+}
+
+// NewCustomExporter creates the CustomExporter of a custom metrics set.
+func NewCustomExporter(context Context, customMetrics CustomMetrics) (*CustomExporter, error) {
+	source := "custom metrics " + customMetrics.Name
+	var placeholders []string
+	for _, placeholder := range routePlaceholders {
+		if strings.Contains(customMetrics.Route, "{"+placeholder+"}") {
+			placeholders = append(placeholders, placeholder)
+		}
+	}
+
+	var list []MetricDefinition
+	var metrics []customMetric
+	for _, metric := range customMetrics.List {
+		labels := make([]string, 0, len(metric.LabelPaths))
+		for label := range metric.LabelPaths {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		labelPaths := make([]string, len(labels))
+		for i, label := range labels {
+			if !model.LabelNameRE.MatchString(label) || strings.HasPrefix(label, "__") {
+				log.Error("Invalid label name ", label, " in ", source)
+				return &CustomExporter{}, fmt.Errorf("invalid label name %q", label)
+			}
+			for _, placeholder := range placeholders {
+				if label == placeholder {
+					log.Error("Label ", label, " in ", source, " is already added by the route")
+					return &CustomExporter{}, fmt.Errorf("duplicate label name %q", label)
+				}
+			}
+			labelPaths[i] = metric.LabelPaths[label]
+			if _, err := parsePath(labelPaths[i]); err != nil {
+				log.Error("Invalid path of label ", label, " in ", source)
+				return &CustomExporter{}, err
+			}
+		}
+		if metric.Each != "" {
+			if _, err := parsePath(metric.Each); err != nil {
+				log.Error("Invalid path ", metric.Each, " in ", source)
+				return &CustomExporter{}, err
+			}
+		}
+		metric.Labels = append(labels, placeholders...)
+		list = append(list, metric.MetricDefinition)
+
+		fqName := p.BuildFQName("cb", customMetrics.Name, metric.Name)
+		metrics = append(metrics, customMetric{
+			typedDesc:  newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric.MetricDefinition),
+			name:       fqName,
+			id:         metric.ID,
+			each:       metric.Each,
+			labelPaths: labelPaths,
+			duplicated: &sync.Once{},
+		})
+	}
+	err := validateMetrics(list, source)
+	if err != nil {
+		return &CustomExporter{}, err
+	}
+
+	return &CustomExporter{
+		context:      context,
+		route:        customMetrics.Route,
+		placeholders: placeholders,
+		metrics:      metrics,
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *CustomExporter) Describe(ch chan<- *p.Desc) {
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *CustomExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	routes, err := e.expandRoute(ctx)
+	if err != nil {
+		log.Error("Error when expanding route " + e.route + ". Custom metrics won't be scraped")
+		return err
+	}
+
+	var list []string
+	for route := range routes {
+		list = append(list, route)
+	}
+
+	// Placeholders can be anywhere in the route, so requests are recorded
+	// under the route of the configuration.
+	bodies, errs := MultiFetch(withRouteTemplate(ctx, e.route), e.context, list)
+
+	// Label sets already emitted by each metric, since a registry fails the
+	// whole scrape on duplicated series.
+	seen := make([]map[string]bool, len(e.metrics))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+
+	var scrapeErr error
+	for route, values := range routes {
+		if err, ok := errs[route]; ok {
+			log.Error("Error when retrieving data of route " + route)
+			scrapeErr = err
+			continue
+		}
+		var doc interface{}
+		err := json.Unmarshal(bodies[route], &doc)
+		if err != nil {
+			log.Error("Could not unmarshal data of route " + route)
+			scrapeErr = err
+			continue
+		}
+		for i, metric := range e.metrics {
+			metric.collect(ch, doc, values, seen[i])
+		}
+	}
+	return scrapeErr
+}
+
+// collect emits the metric for each element found in doc, with the
+// values of the route placeholders appended to its labels. Elements whose
+// labels are in seen are skipped: only the first of them is exported.
+func (m customMetric) collect(ch chan<- p.Metric, doc interface{}, placeholderValues []string, seen map[string]bool) {
+	elements := []interface{}{doc}
+	if m.each != "" {
+		array, ok := JSONPath(doc, m.each)
+		if !ok {
+			return
+		}
+		elements, ok = array.([]interface{})
+		if !ok {
+			return
+		}
+	}
+
+	for _, element := range elements {
+		raw, ok := JSONPath(element, m.id)
+		if !ok {
+			continue
+		}
+		value, ok := m.value(raw)
+		if !ok {
+			continue
+		}
+		labels := make([]string, 0, len(m.labelPaths)+len(placeholderValues))
+		for _, path := range m.labelPaths {
+			label, _ := JSONPath(element, path)
+			labels = append(labels, labelValue(label))
+		}
+		labels = append(labels, placeholderValues...)
+		key := strings.Join(labels, "\xff")
+		if seen[key] {
+			m.duplicated.Do(func() {
+				log.Warn("Metric ", m.name, " has elements with the same labels, only the first one is exported")
+			})
+			continue
+		}
+		seen[key] = true
+		ch <- m.mustNewConstMetric(value, labels...)
+	}
+}
+
+// labelValue converts a value found in a response to a label value.
+func labelValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// expandRoute returns the routes to fetch, with the values of their
+// placeholders in the order of the placeholders of the exporter.
+func (e *CustomExporter) expandRoute(ctx context.Context) (map[string][]string, error) {
+	routes := map[string][]string{e.route: nil}
+	for _, placeholder := range e.placeholders {
+		var values []string
+		var err error
+		switch placeholder {
+		case "bucket":
+			values, err = bucketNames(ctx, e.context)
+		case "node":
+			values, err = nodeHostnames(ctx, e.context)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		expanded := make(map[string][]string)
+		for route, routeValues := range routes {
+			for _, value := range values {
+				r := strings.Replace(route, "{"+placeholder+"}", url.QueryEscape(value), -1)
+				expanded[r] = append(append([]string{}, routeValues...), value)
+			}
+		}
+		routes = expanded
+	}
+	return routes, nil
+}
+
+// bucketNames lists the names of the buckets of the cluster.
+func bucketNames(ctx context.Context, c Context) ([]string, error) {
+	body, err := Fetch(ctx, c, "/pools/default/buckets")
+	if err != nil {
+		return nil, err
+	}
+	var buckets []BucketData
+	err = json.Unmarshal(body, &buckets)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		names[i] = bucket.Name
+	}
+	return names, nil
+}
+
+// nodeHostnames lists the hostnames of the nodes of the cluster.
+func nodeHostnames(ctx context.Context, c Context) ([]string, error) {
+	body, err := Fetch(ctx, c, "/pools/default")
+	if err != nil {
+		return nil, err
+	}
+	var cluster struct {
+		Nodes []NodeData `json:"nodes"`
+	}
+	err = json.Unmarshal(body, &cluster)
+	if err != nil {
+		return nil, err
+	}
+	hostnames := make([]string, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		hostnames[i] = node.Hostname
+	}
+	return hostnames, nil
+}
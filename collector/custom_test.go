@@ -0,0 +1,101 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewCustomExporter(t *testing.T) {
+	tests := []struct {
+		name       string
+		route      string
+		labelPaths map[string]string
+		each       string
+		err        bool
+	}{
+		{name: "valid", route: "/pools/default/buckets/{bucket}/stats", labelPaths: map[string]string{"kind": "kind"}, each: "items"},
+		{name: "invalid label name", route: "/pools/default", labelPaths: map[string]string{"kind-name": "kind"}, err: true},
+		{name: "reserved label name", route: "/pools/default", labelPaths: map[string]string{"__kind": "kind"}, err: true},
+		{name: "label added by the route", route: "/pools/default/buckets/{bucket}/stats", labelPaths: map[string]string{"bucket": "name"}, err: true},
+		{name: "invalid label path", route: "/pools/default", labelPaths: map[string]string{"kind": "kind["}, err: true},
+		{name: "invalid each path", route: "/pools/default", each: "items[", err: true},
+	}
+	for _, test := range tests {
+		_, err := NewCustomExporter(Context{}, CustomMetrics{Name: "custom", Route: test.route, List: []CustomMetricDefinition{{
+			MetricDefinition: MetricDefinition{Name: "items", ID: "count"},
+			Each:             test.each,
+			LabelPaths:       test.labelPaths,
+		}}})
+		if (err != nil) != test.err {
+			t.Errorf("%s: NewCustomExporter() error = %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCustomExpandRoute(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/pools/default/buckets": `[{"name": "travel sample"}, {"name": "beer"}]`,
+		"/pools/default":         `{"nodes": [{"hostname": "10.0.0.1:8091"}]}`,
+	})
+	defer server.Close()
+
+	e, err := NewCustomExporter(Context{URI: server.URL, Timeout: time.Second}, CustomMetrics{
+		Name:  "custom",
+		Route: "/pools/default/buckets/{bucket}/nodes/{node}/stats",
+		List:  []CustomMetricDefinition{{MetricDefinition: MetricDefinition{Name: "items", ID: "count"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := e.expandRoute(context.Background())
+	if err != nil {
+		t.Fatalf("expandRoute() error = %v", err)
+	}
+	want := map[string][]string{
+		"/pools/default/buckets/travel+sample/nodes/10.0.0.1%3A8091/stats": {"travel sample", "10.0.0.1:8091"},
+		"/pools/default/buckets/beer/nodes/10.0.0.1%3A8091/stats":          {"beer", "10.0.0.1:8091"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("expandRoute() = %v, want %v", routes, want)
+	}
+}
+
+func TestCustomExporter(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/pools/default/buckets":             `[{"name": "travel"}, {"name": "beer"}]`,
+		"/pools/default/buckets/travel/docs": `{"items": [{"kind": "hotel", "count": 10}, {"kind": "airport", "count": "3"}, {"kind": "hotel", "count": 4}]}`,
+		"/pools/default/buckets/beer/docs":   `{"items": [{"kind": "brewery", "count": 7}, {"kind": "beer"}]}`,
+	})
+	defer server.Close()
+
+	e, err := NewCustomExporter(Context{URI: server.URL, Timeout: time.Second}, CustomMetrics{
+		Name:  "docs",
+		Route: "/pools/default/buckets/{bucket}/docs",
+		List: []CustomMetricDefinition{{
+			MetricDefinition: MetricDefinition{Name: "count", ID: "count"},
+			Each:             "items",
+			LabelPaths:       map[string]string{"kind": "kind"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, e)
+	if err != nil {
+		t.Fatalf("Scrape() error = %v", err)
+	}
+	want := map[string]float64{
+		`cb_docs_count{bucket="travel",kind="hotel"}`:   10,
+		`cb_docs_count{bucket="travel",kind="airport"}`: 3,
+		`cb_docs_count{bucket="beer",kind="brewery"}`:   7,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Scrape() exported %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// eventingStatusRoute is the route of the status of the eventing functions.
+const eventingStatusRoute = "/api/v1/status"
+
+// EventingExporter encapsulates eventing metrics and context.
+type EventingExporter struct {
+	context       Context
+	route         string
+	statusMetrics map[string]typedDesc
+	metrics       map[string]typedDesc
+}
+
+// NewEventingExporter creates the EventingExporter and fill it with metrics metadata from the metrics file.
+func NewEventingExporter(c Context) (*EventingExporter, error) {
+	eventingMetrics, err := GetMetricsFromFile(c, "eventing")
+	if err != nil {
+		return &EventingExporter{}, err
+	}
+	return &EventingExporter{
+		context:       c,
+		route:         eventingMetrics.Route,
+		statusMetrics: routeMetrics(c, eventingMetrics, eventingStatusRoute),
+		metrics:       routeMetrics(c, eventingMetrics, eventingMetrics.Route),
+	}, nil
+}
+
+// Describe describes exported metrics
+func (e *EventingExporter) Describe(ch chan<- *p.Desc) {
+	for _, metric := range e.statusMetrics {
+		ch <- metric.desc
+	}
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric
+func (e *EventingExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	nodes, err := serviceNodes(ctx, e.context, "eventing", "8096", "18096")
+	if err != nil {
+		log.Error("Error when retrieving eventing nodes. Eventing metrics won't be scraped")
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	// Function status is the same on every eventing node.
+	var scrapeErr error
+	body, err := Fetch(ctx, nodes[0].context, eventingStatusRoute)
+	if err != nil {
+		log.Error("Could not retrieve eventing functions status")
+		scrapeErr = err
+	} else {
+		var status struct {
+			Apps []map[string]interface{} `json:"apps"`
+		}
+		err = json.Unmarshal(body, &status)
+		if err != nil {
+			log.Error("Could not unmarshal eventing functions status")
+			scrapeErr = err
+		}
+
+		for _, app := range status.Apps {
+			name, _ := app["name"].(string)
+			collectPaths(ch, e.statusMetrics, app, name)
+		}
+	}
+
+	// Execution and failure stats are specific to each eventing node.
+	bodies, errs := fetchNodes(ctx, e.context, nodes, e.route)
+	for i, node := range nodes {
+		if err, ok := errs[i][e.route]; ok {
+			log.Error("Could not retrieve eventing stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		var functions []map[string]interface{}
+		err := json.Unmarshal(bodies[i][e.route], &functions)
+		if err != nil {
+			log.Error("Could not unmarshal eventing stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+
+		for _, function := range functions {
+			name, _ := function["function_name"].(string)
+			collectPaths(ch, e.metrics, function, name, node.hostname)
+		}
+	}
+	return scrapeErr
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEventingMetrics(t *testing.T) {
+	e, err := NewEventingExporter(Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apps, functions []map[string]interface{}
+	err = json.Unmarshal([]byte(`[
+		{"name": "enrich", "composite_status": "deployed"},
+		{"name": "archive", "composite_status": "paused"},
+		{"name": "audit", "composite_status": "migrating"}
+	]`), &apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(`[
+		{"function_name": "enrich", "events_remaining": {"dcp_backlog": 5}, "execution_stats": {"on_update_success": 40}, "failure_stats": {"timeout_count": 2}}
+	]`), &functions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		for _, app := range apps {
+			collectPaths(ch, e.statusMetrics, app, app["name"].(string))
+		}
+		for _, function := range functions {
+			collectPaths(ch, e.metrics, function, function["function_name"].(string), "10.0.0.1:8091")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrich := `{function="enrich",node="10.0.0.1:8091"}`
+	want := map[string]float64{
+		`cb_eventing_status{function="enrich"}`:        1,
+		`cb_eventing_status{function="archive"}`:       2,
+		"cb_eventing_dcp_backlog" + enrich:             5,
+		"cb_eventing_on_update_success_total" + enrich: 40,
+		"cb_eventing_timeout_total" + enrich:           2,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("exported %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// FTSExporter encapsulates full text search metrics and context.
+type FTSExporter struct {
+	context      Context
+	route        string
+	nodeMetrics  map[string]typedDesc
+	indexMetrics map[string]typedDesc
+}
+
+// NewFTSExporter creates the FTSExporter and fill it with metrics metadata from the metrics file.
+func NewFTSExporter(context Context) (*FTSExporter, error) {
+	ftsMetrics, err := GetMetricsFromFile(context, "fts")
+	if err != nil {
+		return &FTSExporter{}, err
+	}
+	// Metrics labelled with an index are read from per-index stats,
+	// the others are read from node stats.
+	nodeMetrics := make(map[string]typedDesc)
+	indexMetrics := make(map[string]typedDesc)
+	for _, metric := range ftsMetrics.List {
+		fqName := p.BuildFQName("cb", ftsMetrics.Name, metric.Name)
+		desc := newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
+		if len(metric.Labels) > 1 {
+			indexMetrics[metric.ID] = desc
+		} else {
+			nodeMetrics[metric.ID] = desc
+		}
+	}
+	return &FTSExporter{
+		context:      context,
+		route:        ftsMetrics.Route,
+		nodeMetrics:  nodeMetrics,
+		indexMetrics: indexMetrics,
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *FTSExporter) Describe(ch chan<- *p.Desc) {
+	for _, metric := range e.nodeMetrics {
+		ch <- metric.desc
+	}
+	for _, metric := range e.indexMetrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *FTSExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	nodes, err := serviceNodes(ctx, e.context, "fts", "8094", "18094")
+	if err != nil {
+		log.Error("Error when retrieving fts nodes. FTS metrics won't be scraped")
+		return err
+	}
+
+	var scrapeErr error
+	bodies, errs := fetchNodes(ctx, e.context, nodes, e.route)
+	for i, node := range nodes {
+		if err, ok := errs[i][e.route]; ok {
+			log.Error("Error when retrieving fts stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		var stats map[string]interface{}
+		err := json.Unmarshal(bodies[i][e.route], &stats)
+		if err != nil {
+			log.Error("Could not unmarshal fts stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+
+		collectPaths(ch, e.nodeMetrics, stats, node.hostname)
+		for index, indexStats := range splitFTSStats(stats) {
+			collectPaths(ch, e.indexMetrics, indexStats, index[0], index[1], node.hostname)
+		}
+	}
+	return scrapeErr
+}
+
+// splitFTSStats groups the stats of each index by bucket and index, so that
+// metric IDs are paths into the stats of an index. Per-index stats are named
+// <bucket>:<index>:<stat>. Other stats are left out.
+func splitFTSStats(stats map[string]interface{}) map[[2]string]map[string]interface{} {
+	indexes := make(map[[2]string]map[string]interface{})
+	for key, value := range stats {
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		index := [2]string{parts[0], parts[1]}
+		if indexes[index] == nil {
+			indexes[index] = make(map[string]interface{})
+		}
+		indexes[index][parts[2]] = value
+	}
+	return indexes
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSplitFTSStats(t *testing.T) {
+	stats := map[string]interface{}{
+		"num_bytes_used_ram":                       1024.0,
+		"travel:by_name:num_mutations_to_index":    3.0,
+		"travel:by_name:doc_count":                 10.0,
+		"beer:by_brewery:doc_count":                5.0,
+		"travel:inventory:hotel:by_name:doc_count": 7.0,
+	}
+	want := map[[2]string]map[string]interface{}{
+		{"travel", "by_name"}:  {"num_mutations_to_index": 3.0, "doc_count": 10.0},
+		{"beer", "by_brewery"}: {"doc_count": 5.0},
+	}
+	if got := splitFTSStats(stats); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitFTSStats() = %v, want %v", got, want)
+	}
+}
+
+func TestFTSMetrics(t *testing.T) {
+	e, err := NewFTSExporter(Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]interface{}{
+		"num_bytes_used_ram":                 1024.0,
+		"travel:by_name:doc_count":           10.0,
+		"travel:by_name:avg_queries_latency": 2.5,
+		"travel:by_name:total_queries":       7.0,
+		"travel:by_name:unknown_metric":      1.0,
+		"travel:inventory:by_name:doc_count": 3.0,
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		collectPaths(ch, e.nodeMetrics, stats, "10.0.0.1:8091")
+		for index, indexStats := range splitFTSStats(stats) {
+			collectPaths(ch, e.indexMetrics, indexStats, index[0], index[1], "10.0.0.1:8091")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := `{bucket="travel",index="by_name",node="10.0.0.1:8091"}`
+	want := map[string]float64{
+		`cb_fts_ram_used_bytes{node="10.0.0.1:8091"}`: 1024,
+		"cb_fts_doc_count" + index:                    10,
+		"cb_fts_query_latency_avg_seconds" + index:    0.0025,
+		"cb_fts_queries_total" + index:                7,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("exported %v, want %v", values, want)
+	}
+}
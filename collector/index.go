@@ -0,0 +1,166 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultCollection is the name of the default scope and collection of buckets.
+const defaultCollection = "_default"
+
+// indexStatusRoute is the route of the status of every index of the cluster.
+const indexStatusRoute = "/indexStatus"
+
+// IndexStatusData holds the labels of an index (each element of indexes in /indexStatus)
+type IndexStatusData struct {
+	Bucket     string   `json:"bucket"`
+	Scope      string   `json:"scope"`
+	Collection string   `json:"collection"`
+	Index      string   `json:"index"`
+	Hosts      []string `json:"hosts"`
+}
+
+// IndexExporter encapsulates GSI metrics and context.
+type IndexExporter struct {
+	context       Context
+	route         string
+	statusMetrics map[string]typedDesc
+	metrics       map[string]typedDesc
+}
+
+// NewIndexExporter creates the IndexExporter and fill it with metrics metadata from the metrics file.
+func NewIndexExporter(context Context) (*IndexExporter, error) {
+	indexMetrics, err := GetMetricsFromFile(context, "index")
+	if err != nil {
+		return &IndexExporter{}, err
+	}
+	return &IndexExporter{
+		context:       context,
+		route:         indexMetrics.Route,
+		statusMetrics: routeMetrics(context, indexMetrics, indexStatusRoute),
+		metrics:       routeMetrics(context, indexMetrics, indexMetrics.Route),
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *IndexExporter) Describe(ch chan<- *p.Desc) {
+	for _, metric := range e.statusMetrics {
+		ch <- metric.desc
+	}
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *IndexExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	scrapeErr := e.collectStatus(ctx, ch)
+
+	nodes, err := serviceNodes(ctx, e.context, "index", "9102", "19102")
+	if err != nil {
+		log.Error("Error when retrieving index nodes. Index metrics won't be scraped")
+		return err
+	}
+
+	bodies, errs := fetchNodes(ctx, e.context, nodes, e.route)
+	for i, node := range nodes {
+		if err, ok := errs[i][e.route]; ok {
+			log.Error("Error when retrieving index stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		var stats map[string]interface{}
+		err := json.Unmarshal(bodies[i][e.route], &stats)
+		if err != nil {
+			log.Error("Could not unmarshal index stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+
+		for index, indexStats := range splitIndexStats(stats) {
+			collectPaths(ch, e.metrics, indexStats, index[0], index[1], index[2], index[3], node.hostname)
+		}
+	}
+	return scrapeErr
+}
+
+// splitIndexStats groups the stats of each index by bucket, scope, collection
+// and index, so that metric IDs are paths into the stats of an index. Per-index
+// stats are named <bucket>:<index>:<stat>, or <bucket>:<scope>:<collection>:<index>:<stat>
+// in Couchbase 7. Other stats are left out.
+func splitIndexStats(stats map[string]interface{}) map[[4]string]map[string]interface{} {
+	indexes := make(map[[4]string]map[string]interface{})
+	for key, value := range stats {
+		parts := strings.Split(key, ":")
+		var index [4]string
+		var stat string
+		switch len(parts) {
+		case 3:
+			index, stat = [4]string{parts[0], defaultCollection, defaultCollection, parts[1]}, parts[2]
+		case 5:
+			index, stat = [4]string{parts[0], parts[1], parts[2], parts[3]}, parts[4]
+		default:
+			continue
+		}
+		if indexes[index] == nil {
+			indexes[index] = make(map[string]interface{})
+		}
+		indexes[index][stat] = value
+	}
+	return indexes
+}
+
+// collectStatus exports the status and build progress of each index.
+func (e *IndexExporter) collectStatus(ctx context.Context, ch chan<- p.Metric) error {
+	body, err := Fetch(ctx, e.context, indexStatusRoute)
+	if err != nil {
+		log.Error("Error when retrieving index status. Index status won't be scraped")
+		return err
+	}
+	var indexStatus struct {
+		Indexes []json.RawMessage `json:"indexes"`
+	}
+	err = json.Unmarshal(body, &indexStatus)
+	if err != nil {
+		log.Error("Could not unmarshal index status")
+		return err
+	}
+
+	var scrapeErr error
+	done := make(map[[5]string]bool)
+	for _, raw := range indexStatus.Indexes {
+		var index IndexStatusData
+		var doc interface{}
+		err = json.Unmarshal(raw, &index)
+		if err == nil {
+			err = json.Unmarshal(raw, &doc)
+		}
+		if err != nil {
+			log.Error("Could not unmarshal index status")
+			scrapeErr = err
+			continue
+		}
+		// Indexes of Couchbase 6 belong to the default collection.
+		scope, collection := index.Scope, index.Collection
+		if scope == "" {
+			scope, collection = defaultCollection, defaultCollection
+		}
+		for _, host := range index.Hosts {
+			labels := [5]string{index.Bucket, scope, collection, index.Index, host}
+			if done[labels] {
+				continue
+			}
+			done[labels] = true
+			collectPaths(ch, e.statusMetrics, doc, labels[:]...)
+		}
+	}
+	return scrapeErr
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIndexStatus(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/indexStatus": `{"indexes": [
+			{"bucket": "travel", "index": "by_city", "status": "Ready", "progress": 100, "hosts": ["10.0.0.1:8091", "10.0.0.2:8091"]},
+			{"bucket": "travel", "scope": "inventory", "collection": "hotel", "index": "by_name", "status": "Building", "progress": 42, "hosts": ["10.0.0.1:8091"]},
+			{"bucket": "travel", "index": "by_country", "status": "Moving", "progress": 100, "hosts": ["10.0.0.1:8091"]}
+		]}`,
+	})
+	defer server.Close()
+
+	e, err := NewIndexExporter(Context{URI: server.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(e.collectStatus))
+	if err != nil {
+		t.Fatalf("collectStatus() error = %v", err)
+	}
+
+	byCity := `{bucket="travel",collection="_default",index="by_city",node="%s",scope="_default"}`
+	byName := `{bucket="travel",collection="hotel",index="by_name",node="10.0.0.1:8091",scope="inventory"}`
+	byCountry := `{bucket="travel",collection="_default",index="by_country",node="10.0.0.1:8091",scope="_default"}`
+	want := map[string]float64{
+		"cb_index_status" + fmt.Sprintf(byCity, "10.0.0.1:8091"):         1,
+		"cb_index_status" + fmt.Sprintf(byCity, "10.0.0.2:8091"):         1,
+		"cb_index_build_progress" + fmt.Sprintf(byCity, "10.0.0.1:8091"): 100,
+		"cb_index_build_progress" + fmt.Sprintf(byCity, "10.0.0.2:8091"): 100,
+		"cb_index_status" + byName:                                       2,
+		"cb_index_build_progress" + byName:                               42,
+		"cb_index_build_progress" + byCountry:                            100,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("collectStatus() exported %v, want %v", values, want)
+	}
+}
+
+func TestSplitIndexStats(t *testing.T) {
+	stats := map[string]interface{}{
+		"memory_quota":                                1024.0,
+		"travel:by_city:num_requests":                 3.0,
+		"travel:by_city:items_count":                  10.0,
+		"travel:inventory:hotel:by_name:num_requests": 4.0,
+		"travel:by_city":                              "unexpected",
+	}
+	want := map[[4]string]map[string]interface{}{
+		{"travel", defaultCollection, defaultCollection, "by_city"}: {"num_requests": 3.0, "items_count": 10.0},
+		{"travel", "inventory", "hotel", "by_name"}:                 {"num_requests": 4.0},
+	}
+	if got := splitIndexStats(stats); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitIndexStats() = %v, want %v", got, want)
+	}
+}
+
+func TestIndexStatsMetrics(t *testing.T) {
+	e, err := NewIndexExporter(Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]interface{}{
+		"memory_quota":                                  1024.0,
+		"travel:by_city:items_count":                    10.0,
+		"travel:by_city:avg_scan_latency":               2.5e6,
+		"travel:inventory:hotel:by_name:items_count":    4.0,
+		"travel:inventory:hotel:by_name:unknown_metric": 1.0,
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		for index, indexStats := range splitIndexStats(stats) {
+			collectPaths(ch, e.metrics, indexStats, index[0], index[1], index[2], index[3], "10.0.0.1:8091")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCity := `{bucket="travel",collection="_default",index="by_city",node="10.0.0.1:8091",scope="_default"}`
+	byName := `{bucket="travel",collection="hotel",index="by_name",node="10.0.0.1:8091",scope="inventory"}`
+	want := map[string]float64{
+		"cb_index_items_count" + byCity:              10,
+		"cb_index_avg_scan_latency_seconds" + byCity: 0.0025,
+		"cb_index_items_count" + byName:              4,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("exported %v, want %v", values, want)
+	}
+}
@@ -5,135 +5,160 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
-	"strconv"
+	"sort"
+	"strings"
 
 	p "github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-// NodeData (/nodes/self)
+// NodeData holds the labels of a node (/nodes/self or each element of nodes in /pools/default)
 type NodeData struct {
-	StorageTotals struct {
-		RAM struct {
-			Total      float64 `json:"total"`
-			QuotaTotal float64 `json:"quotaTotal"`
-			QuotaUsed  float64 `json:"quotaUsed"`
-			Used       float64 `json:"used"`
-			UsedByData float64 `json:"usedByData"`
-		} `json:"ram"`
-		Hdd struct {
-			Total      float64 `json:"total"`
-			QuotaTotal float64 `json:"quotaTotal"`
-			Used       float64 `json:"used"`
-			UsedByData float64 `json:"usedByData"`
-			Free       float64 `json:"free"`
-		} `json:"hdd"`
-	} `json:"storageTotals"`
-	SystemStats struct {
-		CPUUtilizationRate float64 `json:"cpu_utilization_rate"`
-		SwapTotal          float64 `json:"swap_total"`
-		SwapUsed           float64 `json:"swap_used"`
-	} `json:"systemStats"`
-	InterestingStats struct {
-		CmdGet                       float64 `json:"cmd_get"`
-		CouchDocsActualDiskSize      float64 `json:"couch_docs_actual_disk_size"`
-		CouchDocsDataSize            float64 `json:"couch_docs_data_size"`
-		CouchSpatialDataSize         float64 `json:"couch_spatial_data_size"`
-		CouchSpatialDiskSize         float64 `json:"couch_spatial_disk_size"`
-		CouchViewsActualDiskSize     float64 `json:"couch_views_actual_disk_size"`
-		CouchViewsDataSize           float64 `json:"couch_views_data_size"`
-		CurrItems                    float64 `json:"curr_items"`
-		CurrItemsTot                 float64 `json:"curr_items_tot"`
-		EpBgFetched                  float64 `json:"ep_bg_fetched"`
-		GetHits                      float64 `json:"get_hits"`
-		MemUsed                      float64 `json:"mem_used"`
-		Ops                          float64 `json:"ops"`
-		VbReplicaCurrItems           float64 `json:"vb_replica_curr_items"`
-		VbActiveNumNonResidentNumber float64 `json:"vb_active_num_non_residentNumber"` // couchbase 5.1.1
-	} `json:"interestingStats"`
-	Uptime            string  `json:"uptime"`
-	ClusterMembership string  `json:"clusterMembership"`
-	Status            string  `json:"status"`
-	FtsMemoryQuota    float64 `json:"ftsMemoryQuota"`
-	IndexMemoryQuota  float64 `json:"indexMemoryQuota"`
-	MemoryQuota       float64 `json:"memoryQuota"`
+	Status            string   `json:"status"`
+	ClusterMembership string   `json:"clusterMembership"`
+	Hostname          string   `json:"hostname"`
+	OTPNode           string   `json:"otpNode"`
+	Services          []string `json:"services"`
+	Version           string   `json:"version"`
+}
+
+// nodeLabels are added to node metrics when all nodes of the cluster are scraped.
+var nodeLabels = []string{"node", "hostname", "services", "version"}
+
+// selfOnlyKeys are the keys of /nodes/self that the nodes listed by /pools/default
+// don't have. Metrics read from them are not scraped when all nodes are scraped.
+var selfOnlyKeys = map[string]bool{
+	"storageTotals":    true,
+	"memoryQuota":      true,
+	"indexMemoryQuota": true,
+	"ftsMemoryQuota":   true,
 }
 
 // NodeExporter encapsulates node metrics and context.
 type NodeExporter struct {
 	context Context
 	route   string
-	up      p.Gauge
-	metrics map[string]*p.Desc
+	up      *p.Desc
+	metrics map[string]typedDesc
 }
 
 // NewNodeExporter creates the NodeExporter and fill it with metrics metadata from the metrics file.
 func NewNodeExporter(context Context) (*NodeExporter, error) {
-	nodeMetrics, err := GetMetricsFromFile("node")
+	nodeMetrics, err := GetMetricsFromFile(context, "node")
 	if err != nil {
 		return &NodeExporter{}, err
 	}
+	// In cluster-wide mode, every node of /pools/default is scraped and identified by labels.
+	var upLabels []string
+	route := nodeMetrics.Route
+	if context.ScrapeAllNodes {
+		upLabels = nodeLabels
+		route = "/pools/default"
+	}
 	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
-	metrics := make(map[string]*p.Desc, len(nodeMetrics.List))
+	metrics := make(map[string]typedDesc, len(nodeMetrics.List))
+	var unsupported []string
 	for _, metric := range nodeMetrics.List {
 		fqName := p.BuildFQName("cb", nodeMetrics.Name, metric.Name)
-		metrics[metric.ID] = p.NewDesc(fqName, metric.Description, metric.Labels, nil)
+		if context.ScrapeAllNodes && selfOnly(metric.ID) {
+			unsupported = append(unsupported, fqName)
+			continue
+		}
+		metrics[metric.ID] = newTypedDesc(context, p.NewDesc(fqName, metric.Description, append(metric.Labels, upLabels...), nil), metric)
+	}
+	if len(unsupported) > 0 {
+		log.Warn("Metrics ", strings.Join(unsupported, ", "), " only exist for the target node and won't be scraped for all nodes")
 	}
 	return &NodeExporter{
 		context: context,
-		route:   nodeMetrics.Route,
-		up: p.NewGauge(p.GaugeOpts{
-			Name: p.BuildFQName("cb", nodeMetrics.Name, "service_up"),
-			Help: "Couchbase service healthcheck",
-		}),
+		route:   route,
+		up:      p.NewDesc(p.BuildFQName("cb", nodeMetrics.Name, "service_up"), "Couchbase service healthcheck", upLabels, nil),
 		metrics: metrics,
 	}, nil
 }
 
+// selfOnly tells whether the metric with the given ID is read from a key of
+// /nodes/self missing from the nodes of /pools/default.
+func selfOnly(id string) bool {
+	segments, err := parsePath(id)
+	return err == nil && len(segments) > 0 && selfOnlyKeys[segments[0].key]
+}
+
 // Describe describes exported metrics.
 func (e *NodeExporter) Describe(ch chan<- *p.Desc) {
-	ch <- e.up.Desc()
+	ch <- e.up
 	for _, metric := range e.metrics {
-		ch <- metric
+		ch <- metric.desc
 	}
 }
 
-// Collect fetches data for each exported metric.
-func (e *NodeExporter) Collect(ch chan<- p.Metric) {
-	e.up.Set(0)
-	defer func() { ch <- e.up }()
-	body, err := Fetch(e.context, e.route)
+// Scrape fetches data for each exported metric.
+func (e *NodeExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	if e.context.ScrapeAllNodes {
+		return e.collectAllNodes(ctx, ch)
+	}
+
+	var up float64
+	defer func() { ch <- p.MustNewConstMetric(e.up, p.GaugeValue, up) }()
+	body, err := Fetch(ctx, e.context, e.route)
 	if err != nil {
 		log.Error("Error when retrieving node data. Node metrics won't be scraped")
-		return
+		return err
 	}
-	var node NodeData
+	var node interface{}
 	err = json.Unmarshal(body, &node)
 	if err != nil {
 		log.Error("Could not unmarshal node data")
-		return
+		return err
 	}
 
-	statusValues := map[string]float64{"healthy": 1, "active": 1, "warmup": 2, "inactiveHealthy": 2, "inactiveFailed": 3}
-
-	e.up.Set(1)
-	flat := FlattenStruct(node)
-	for id, metric := range e.metrics {
-		if value, ok := flat[id]; ok {
-			switch value.(type) {
-			case string:
-				var v float64
-				uptime, err := strconv.Atoi(value.(string))
-				if err == nil {
-					v = float64(uptime)
-				} else {
-					v = statusValues[value.(string)]
-				}
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, v)
-			case float64:
-				ch <- p.MustNewConstMetric(metric, p.GaugeValue, value.(float64))
-			}
+	up = 1
+	collectPaths(ch, e.metrics, node)
+	return nil
+}
+
+// collectAllNodes emits metrics of every node found in the cluster. Nodes that
+// don't respond are still listed by the cluster with an unhealthy status.
+func (e *NodeExporter) collectAllNodes(ctx context.Context, ch chan<- p.Metric) error {
+	body, err := Fetch(ctx, e.context, e.route)
+	if err != nil {
+		log.Error("Error when retrieving cluster nodes data. Node metrics won't be scraped")
+		return err
+	}
+	var cluster struct {
+		Nodes []json.RawMessage `json:"nodes"`
+	}
+	err = json.Unmarshal(body, &cluster)
+	if err != nil {
+		log.Error("Could not unmarshal cluster nodes data")
+		return err
+	}
+
+	var scrapeErr error
+	for _, raw := range cluster.Nodes {
+		var node NodeData
+		var doc interface{}
+		err = json.Unmarshal(raw, &node)
+		if err == nil {
+			err = json.Unmarshal(raw, &doc)
+		}
+		if err != nil {
+			log.Error("Could not unmarshal node data")
+			scrapeErr = err
+			continue
+		}
+		services := append([]string{}, node.Services...)
+		sort.Strings(services)
+		labels := []string{node.OTPNode, node.Hostname, strings.Join(services, ","), node.Version}
+
+		var up float64
+		if node.Status == "healthy" {
+			up = 1
 		}
+		ch <- p.MustNewConstMetric(e.up, p.GaugeValue, up, labels...)
+		collectPaths(ch, e.metrics, doc, labels...)
 	}
+	return scrapeErr
 }
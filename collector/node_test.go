@@ -0,0 +1,84 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeExporterAllNodes(t *testing.T) {
+	server := serveRoutes(map[string]string{
+		"/pools/default": `{
+			"storageTotals": {"ram": {"total": 100}},
+			"nodes": [
+				{
+					"hostname": "10.0.0.1:8091", "otpNode": "ns_1@10.0.0.1", "version": "6.6.0-7909-enterprise",
+					"services": ["kv", "index"], "status": "healthy", "clusterMembership": "active",
+					"uptime": "3600", "systemStats": {"cpu_utilization_rate": 12.5}
+				},
+				{
+					"hostname": "10.0.0.2:8091", "otpNode": "ns_1@10.0.0.2", "version": "6.6.0-7909-enterprise",
+					"services": ["n1ql"], "status": "unhealthy", "clusterMembership": "inactiveFailed"
+				}
+			]
+		}`,
+	})
+	defer server.Close()
+
+	e, err := NewNodeExporter(Context{URI: server.URL, Timeout: time.Second, ScrapeAllNodes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range e.metrics {
+		if selfOnly(id) {
+			t.Errorf("NewNodeExporter() reads %s from nodes of /pools/default", id)
+		}
+	}
+
+	values, err := scrapeMetrics(t, e)
+	if err != nil {
+		t.Fatalf("Scrape() error = %v", err)
+	}
+	first := `{hostname="10.0.0.1:8091",node="ns_1@10.0.0.1",services="index,kv",version="6.6.0-7909-enterprise"}`
+	second := `{hostname="10.0.0.2:8091",node="ns_1@10.0.0.2",services="n1ql",version="6.6.0-7909-enterprise"}`
+	want := map[string]float64{
+		"cb_node_service_up" + first:           1,
+		"cb_node_status" + first:               1,
+		"cb_node_cluster_membership" + first:   1,
+		"cb_node_uptime_seconds" + first:       3600,
+		"cb_node_cpu_utilization_rate" + first: 12.5,
+		"cb_node_service_up" + second:          0,
+		"cb_node_status" + second:              0,
+		"cb_node_cluster_membership" + second:  3,
+	}
+	for name, value := range want {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("%s = %v (exported: %v), want %v", name, got, ok, value)
+		}
+	}
+	if len(values) != len(want) {
+		t.Errorf("Scrape() exported %d metrics, want %d: %v", len(values), len(want), values)
+	}
+}
+
+func TestSelfOnly(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "storageTotals.ram.total", want: true},
+		{id: "memoryQuota", want: true},
+		{id: "ftsMemoryQuota", want: true},
+		{id: "systemStats.cpu_utilization_rate", want: false},
+		{id: "interestingStats.curr_items", want: false},
+		{id: "uptime", want: false},
+	}
+	for _, test := range tests {
+		if got := selfOnly(test.id); got != test.want {
+			t.Errorf("selfOnly(%q) = %v, want %v", test.id, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryExporter encapsulates query service metrics and context.
+type QueryExporter struct {
+	context Context
+	route   string
+	metrics map[string]typedDesc
+}
+
+// NewQueryExporter creates the QueryExporter and fill it with metrics metadata from the metrics file.
+func NewQueryExporter(context Context) (*QueryExporter, error) {
+	queryMetrics, err := GetMetricsFromFile(context, "query")
+	if err != nil {
+		return &QueryExporter{}, err
+	}
+	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
+	metrics := make(map[string]typedDesc, len(queryMetrics.List))
+	for _, metric := range queryMetrics.List {
+		fqName := p.BuildFQName("cb", queryMetrics.Name, metric.Name)
+		metrics[metric.ID] = newTypedDesc(context, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
+	}
+	return &QueryExporter{
+		context: context,
+		route:   queryMetrics.Route,
+		metrics: metrics,
+	}, nil
+}
+
+// Describe describes exported metrics.
+func (e *QueryExporter) Describe(ch chan<- *p.Desc) {
+	for _, metric := range e.metrics {
+		ch <- metric.desc
+	}
+}
+
+// Scrape fetches data for each exported metric.
+func (e *QueryExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
+	nodes, err := serviceNodes(ctx, e.context, "n1ql", "8093", "18093")
+	if err != nil {
+		log.Error("Error when retrieving query nodes. Query metrics won't be scraped")
+		return err
+	}
+
+	vitalsRoute, statsRoute := e.route+"/vitals", e.route+"/stats"
+	bodies, errs := fetchNodes(ctx, e.context, nodes, vitalsRoute, statsRoute)
+
+	var scrapeErr error
+	for i, node := range nodes {
+		var vitals, stats interface{}
+		if err, ok := errs[i][vitalsRoute]; ok {
+			log.Error("Error when retrieving query vitals of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		err = json.Unmarshal(bodies[i][vitalsRoute], &vitals)
+		if err != nil {
+			log.Error("Could not unmarshal query vitals of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		if err, ok := errs[i][statsRoute]; ok {
+			log.Error("Error when retrieving query stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+		err = json.Unmarshal(bodies[i][statsRoute], &stats)
+		if err != nil {
+			log.Error("Could not unmarshal query stats of node " + node.hostname)
+			scrapeErr = err
+			continue
+		}
+
+		// Metric IDs start with the route they are read from.
+		query := map[string]interface{}{"vitals": vitals, "stats": stats}
+		collectPaths(ch, e.metrics, query, node.hostname)
+	}
+	return scrapeErr
+}
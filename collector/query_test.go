@@ -0,0 +1,52 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	e, err := NewQueryExporter(Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query interface{}
+	err = json.Unmarshal([]byte(`{
+		"vitals": {"uptime": "1h0m0.5s", "request.completed.count": 42, "request_time.mean": "12.5ms"},
+		"stats": {"requests.count": 50, "errors.count": 3}
+	}`), &query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := scrapeMetrics(t, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		collectPaths(ch, e.metrics, query, "10.0.0.1:8091")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := `{node="10.0.0.1:8091"}`
+	want := map[string]float64{
+		"cb_query_uptime_seconds" + node:            3600.5,
+		"cb_query_requests_completed_total" + node:  42,
+		"cb_query_request_time_mean_seconds" + node: 0.0125,
+		"cb_query_requests_total" + node:            50,
+		"cb_query_errors_total" + node:              3,
+	}
+	for name, value := range want {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("%s = %v (exported: %v), want %v", name, got, ok, value)
+		}
+	}
+	if len(values) != len(want) {
+		t.Errorf("exported %d metrics, want %d: %v", len(values), len(want), values)
+	}
+}
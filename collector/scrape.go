@@ -0,0 +1,268 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// scraper is implemented by every exporter. Scrape sends metrics to ch and
+// returns an error if some of them could not be scraped. Requests made by
+// Scrape must not outlive ctx.
+type scraper interface {
+	Describe(ch chan<- *p.Desc)
+	Scrape(ctx context.Context, ch chan<- p.Metric) error
+}
+
+// Collectors regroups the exporters of a cluster. Exporters are created once
+// and scraped with the context of each scrape through the collector returned
+// by Bind, while metrics about the exporter itself persist across scrapes.
+type Collectors struct {
+	// registry checks that descriptors of exporters don't collide.
+	registry   *p.Registry
+	collectors []*instrumentedCollector
+	http       *httpMetrics
+	cluster    *clusterInfo
+}
+
+// register adds the exporter named name to the collectors, unless its
+// descriptors collide with the ones of other exporters.
+func (cs *Collectors) register(name string, s scraper) error {
+	c := newInstrumentedCollector(name, s)
+	err := cs.registry.Register(describer(c.Describe))
+	if err != nil {
+		return err
+	}
+	cs.collectors = append(cs.collectors, c)
+	return nil
+}
+
+// mustRegister is like register but panics if descriptors collide.
+func (cs *Collectors) mustRegister(name string, s scraper) {
+	if err := cs.register(name, s); err != nil {
+		panic(err)
+	}
+}
+
+// Refresh reads the version of the cluster. Otherwise it is read on the first scrape.
+func (cs *Collectors) Refresh(ctx context.Context) error {
+	return cs.cluster.refresh(ctx)
+}
+
+// Bind returns a Prometheus collector scraping every exporter with ctx.
+func (cs *Collectors) Bind(ctx context.Context) p.Collector {
+	return &boundCollectors{Collectors: cs, ctx: ctx}
+}
+
+// boundCollectors are collectors bound to the context of a scrape.
+type boundCollectors struct {
+	*Collectors
+	ctx context.Context
+}
+
+// Describe describes exported metrics.
+func (b *boundCollectors) Describe(ch chan<- *p.Desc) {
+	b.cluster.describe(ch)
+	b.http.describe(ch)
+	for _, c := range b.collectors {
+		c.Describe(ch)
+	}
+}
+
+// Collect exports the cluster information first, since exporters skip metrics
+// missing from the version of the cluster. Then it scrapes exporters concurrently,
+// and exports the requests made to Couchbase, including the ones of this scrape.
+func (b *boundCollectors) Collect(ch chan<- p.Metric) {
+	b.cluster.collect(b.ctx, ch)
+	var wg sync.WaitGroup
+	for _, c := range b.collectors {
+		wg.Add(1)
+		go func(c *instrumentedCollector) {
+			defer wg.Done()
+			c.collect(b.ctx, ch)
+		}(c)
+	}
+	wg.Wait()
+	b.http.collect(ch)
+}
+
+// describer adapts a Describe method to a Prometheus collector without
+// metrics, so that descriptors can be checked by a registry.
+type describer func(ch chan<- *p.Desc)
+
+func (d describer) Describe(ch chan<- *p.Desc) { d(ch) }
+
+func (d describer) Collect(ch chan<- p.Metric) {}
+
+// instrumentedCollector wraps an exporter to export the duration, the
+// success and the errors of its scrapes.
+type instrumentedCollector struct {
+	name     string
+	scraper  scraper
+	duration *p.Desc
+	success  *p.Desc
+	errors   *p.CounterVec
+}
+
+// newInstrumentedCollector creates the Prometheus collector of an exporter.
+// The collector name is a constant label so that descriptors of different
+// exporters don't collide.
+func newInstrumentedCollector(name string, s scraper) *instrumentedCollector {
+	labels := p.Labels{"collector": name}
+	return &instrumentedCollector{
+		name:    name,
+		scraper: s,
+		duration: p.NewDesc("cb_exporter_scrape_duration_seconds",
+			"Duration of the last scrape of the collector",
+			nil, labels),
+		success: p.NewDesc("cb_exporter_scrape_success",
+			"Whether the last scrape of the collector succeeded. 1:success, 0:failure",
+			nil, labels),
+		errors: p.NewCounterVec(p.CounterOpts{
+			Name:        "cb_exporter_scrape_errors_total",
+			Help:        "Number of failed scrapes of the collector by reason",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+	}
+}
+
+// Describe describes exported metrics.
+func (c *instrumentedCollector) Describe(ch chan<- *p.Desc) {
+	ch <- c.duration
+	ch <- c.success
+	c.errors.Describe(ch)
+	c.scraper.Describe(ch)
+}
+
+// collect scrapes the exporter and exports the duration and the result of the scrape.
+func (c *instrumentedCollector) collect(ctx context.Context, ch chan<- p.Metric) {
+	start := time.Now()
+	err := c.scraper.Scrape(ctx, ch)
+	ch <- p.MustNewConstMetric(c.duration, p.GaugeValue, time.Since(start).Seconds())
+
+	var success float64
+	if err == nil {
+		success = 1
+	} else {
+		log.Debug("Scrape of ", c.name, " collector failed: ", err)
+		c.errors.WithLabelValues(errorReason(err)).Inc()
+	}
+	ch <- p.MustNewConstMetric(c.success, p.GaugeValue, success)
+	c.errors.Collect(ch)
+}
+
+// errorReason classifies a scrape error: http_<code> when Couchbase responded
+// with an error status, timeout or canceled when the scrape or a request ran
+// out of time or was abandoned, network when Couchbase didn't respond, and
+// decode when the response could not be unmarshalled.
+func errorReason(err error) string {
+	var statusErr *HTTPStatusError
+	var urlErr *url.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &statusErr):
+		return "http_" + strconv.Itoa(statusErr.Code)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &urlErr):
+		return "network"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "decode"
+	}
+	return "other"
+}
+
+// httpMetrics holds metrics about the requests made to Couchbase.
+type httpMetrics struct {
+	requests *p.CounterVec
+	duration p.Histogram
+}
+
+// newHTTPMetrics creates the metrics of the requests made to Couchbase
+// and registers them with the given registerer.
+func newHTTPMetrics(r p.Registerer) *httpMetrics {
+	m := &httpMetrics{
+		requests: p.NewCounterVec(p.CounterOpts{
+			Name: "cb_exporter_http_requests_total",
+			Help: "Number of requests made to Couchbase by route and status code",
+		}, []string{"route", "code"}),
+		duration: p.NewHistogram(p.HistogramOpts{
+			Name:    "cb_exporter_http_request_duration_seconds",
+			Help:    "Duration of the requests made to Couchbase",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}),
+	}
+	r.MustRegister(m.requests, m.duration)
+	return m
+}
+
+// describe describes the metrics of the requests.
+func (m *httpMetrics) describe(ch chan<- *p.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+// collect exports the metrics of the requests.
+func (m *httpMetrics) collect(ch chan<- p.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+}
+
+// observe records a request to route. Code is 0 if no response was received.
+func (m *httpMetrics) observe(ctx context.Context, route string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	status := "error"
+	if code != 0 {
+		status = strconv.Itoa(code)
+	}
+	m.requests.WithLabelValues(routeLabel(ctx, route), status).Inc()
+	m.duration.Observe(duration.Seconds())
+}
+
+// routeTemplateKey is the context key of the template of the routes fetched
+// with the context.
+type routeTemplateKey struct{}
+
+// withRouteTemplate returns a copy of ctx whose requests are recorded under
+// template, for routes built from a template given by the user.
+func withRouteTemplate(ctx context.Context, template string) context.Context {
+	return context.WithValue(ctx, routeTemplateKey{}, template)
+}
+
+// routeLabel returns the route under which a request to route is recorded.
+// Query strings and the names of buckets, nodes and stats are left out to
+// keep the number of routes bounded.
+func routeLabel(ctx context.Context, route string) string {
+	if template, ok := ctx.Value(routeTemplateKey{}).(string); ok {
+		return strings.SplitN(template, "?", 2)[0]
+	}
+	segments := strings.Split(strings.SplitN(route, "?", 2)[0], "/")
+	for i := 1; i < len(segments); i++ {
+		switch {
+		case segments[i-1] == "buckets":
+			segments[i] = "{bucket}"
+		case segments[i-1] == "nodes" && segments[i] != "self":
+			segments[i] = "{node}"
+		case segments[i-1] == "stats" && i >= 3 && segments[i-3] == "buckets":
+			segments[i] = "{stat}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestErrorReason(t *testing.T) {
+	var syntaxErr error = json.Unmarshal([]byte("{"), &struct{}{})
+	var typeErr error = json.Unmarshal([]byte(`{"name": 1}`), &struct{ Name string }{})
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &HTTPStatusError{Route: "/pools", Code: 503}, want: "http_503"},
+		{err: fmt.Errorf("buckets: %w", &HTTPStatusError{Route: "/pools/default/buckets", Code: 404}), want: "http_404"},
+		{err: &url.Error{Op: "Get", URL: "http://cb:8091/pools", Err: context.DeadlineExceeded}, want: "timeout"},
+		{err: context.Canceled, want: "canceled"},
+		{err: &url.Error{Op: "Get", URL: "http://cb:8091/pools", Err: errors.New("connection refused")}, want: "network"},
+		{err: syntaxErr, want: "decode"},
+		{err: typeErr, want: "decode"},
+		{err: errors.New("unexpected"), want: "other"},
+	}
+	for _, test := range tests {
+		if got := errorReason(test.err); got != test.want {
+			t.Errorf("errorReason(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRouteLabel(t *testing.T) {
+	tests := []struct {
+		template string
+		route    string
+		want     string
+	}{
+		{route: "/pools/default", want: "/pools/default"},
+		{route: "/pools/default/buckets/travel/stats", want: "/pools/default/buckets/{bucket}/stats"},
+		{route: "/pools/default/buckets/travel/nodes/10.0.0.1%3A8091/stats", want: "/pools/default/buckets/{bucket}/nodes/{node}/stats"},
+		{route: "/pools/default/buckets/travel/stats/cmd_get", want: "/pools/default/buckets/{bucket}/stats/{stat}"},
+		{route: "/pools/default/buckets/travel/scopes", want: "/pools/default/buckets/{bucket}/scopes"},
+		{route: "/nodes/self", want: "/nodes/self"},
+		{route: "/pools/default/stats/range", want: "/pools/default/stats/range"},
+		{route: "/pools/default/buckets?basic_stats=true", want: "/pools/default/buckets"},
+		{template: "/settings/{bucket}?v=1", route: "/settings/travel?v=1", want: "/settings/{bucket}"},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.template != "" {
+			ctx = withRouteTemplate(ctx, test.template)
+		}
+		if got := routeLabel(ctx, test.route); got != test.want {
+			t.Errorf("routeLabel(%q) = %q, want %q", test.route, got, test.want)
+		}
+	}
+}
+
+func TestInstrumentedCollector(t *testing.T) {
+	var scrapeErr error
+	c := newInstrumentedCollector("cluster", scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		return scrapeErr
+	}))
+	instrumented := scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		c.collect(ctx, ch)
+		return nil
+	})
+
+	tests := []struct {
+		err     error
+		success float64
+		errors  float64
+	}{
+		{success: 1},
+		{err: &HTTPStatusError{Route: "/pools/default", Code: 500}, success: 0, errors: 1},
+		{err: &HTTPStatusError{Route: "/pools/default", Code: 500}, success: 0, errors: 2},
+		{success: 1, errors: 2},
+	}
+	for i, test := range tests {
+		scrapeErr = test.err
+		values, err := scrapeMetrics(t, instrumented)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := values[`cb_exporter_scrape_success{collector="cluster"}`]; got != test.success {
+			t.Errorf("scrape %d: success = %v, want %v", i, got, test.success)
+		}
+		if got := values[`cb_exporter_scrape_errors_total{collector="cluster",reason="http_500"}`]; got != test.errors {
+			t.Errorf("scrape %d: errors = %v, want %v", i, got, test.errors)
+		}
+		if _, ok := values[`cb_exporter_scrape_duration_seconds{collector="cluster"}`]; !ok {
+			t.Errorf("scrape %d: duration not exported", i)
+		}
+	}
+}
+
+func TestBoundCollectorsContext(t *testing.T) {
+	registry := p.NewRegistry()
+	cs := &Collectors{
+		registry: registry,
+		http:     newHTTPMetrics(registry),
+		cluster:  newClusterInfo(Context{URI: "http://127.0.0.1:1"}),
+	}
+	type key struct{}
+	var got []context.Context
+	var mu sync.Mutex
+	for _, name := range []string{"cluster", "node"} {
+		cs.mustRegister(name, scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+			mu.Lock()
+			got = append(got, ctx)
+			mu.Unlock()
+			return ctx.Err()
+		}))
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "scrape"))
+	cancel()
+	values, err := scrapeMetrics(t, scrapeFunc(func(_ context.Context, ch chan<- p.Metric) error {
+		cs.Bind(ctx).Collect(ch)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Collect() scraped %d exporters, want 2", len(got))
+	}
+	for _, c := range got {
+		if c.Value(key{}) != "scrape" || c.Err() != context.Canceled {
+			t.Errorf("exporter scraped with a context other than the one of the scrape")
+		}
+	}
+	for _, name := range []string{"cluster", "node"} {
+		if values[`cb_exporter_scrape_errors_total{collector="`+name+`",reason="canceled"}`] != 1 {
+			t.Errorf("scrape of %s abandoned without a canceled error: %v", name, values)
+		}
+	}
+}
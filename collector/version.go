@@ -0,0 +1,259 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// version is a Couchbase version: major, minor and patch numbers.
+type version [3]int
+
+// parseVersion parses a version like 6.6 or the implementationVersion of
+// Couchbase: 7.0.2-6703-enterprise. It also returns the number of components
+// given, so that 6.6 can match every 6.6.x version.
+func parseVersion(s string) (version, int, error) {
+	var v version
+	parts := strings.Split(strings.SplitN(s, "-", 2)[0], ".")
+	if len(parts) > len(v) {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, len(parts), nil
+}
+
+// compare returns -1, 0 or 1 when v is lower than, equal to or greater than o.
+func (v version) compare(o version) int {
+	for i := range v {
+		if v[i] < o[i] {
+			return -1
+		}
+		if v[i] > o[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// truncate keeps the n first components of v.
+func (v version) truncate(n int) version {
+	for i := n; i < len(v); i++ {
+		v[i] = 0
+	}
+	return v
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// versionRange holds the versions of Couchbase a metric exists in, from the
+// min_version and max_version of its definition. Bounds are inclusive, and
+// a max_version of 6.6 includes 6.6.x versions.
+type versionRange struct {
+	name    string
+	min     version
+	max     version
+	maxLen  int
+	cluster *clusterInfo
+	skipped sync.Once
+}
+
+// newVersionRange creates the version range of a metric definition. It
+// returns nil when the definition has no bounds or invalid ones.
+func newVersionRange(metric MetricDefinition, cluster *clusterInfo) *versionRange {
+	if metric.MinVersion == "" && metric.MaxVersion == "" {
+		return nil
+	}
+	r := &versionRange{name: metric.Name, cluster: cluster}
+	if metric.MinVersion != "" {
+		min, _, err := parseVersion(metric.MinVersion)
+		if err != nil {
+			return nil
+		}
+		r.min = min
+	}
+	if metric.MaxVersion != "" {
+		max, n, err := parseVersion(metric.MaxVersion)
+		if err != nil {
+			return nil
+		}
+		r.max, r.maxLen = max, n
+	}
+	return r
+}
+
+// supported tells whether the metric exists in the version of the cluster,
+// and logs the first time it doesn't. Metrics are assumed to exist while
+// the version is unknown.
+func (r *versionRange) supported() bool {
+	if r == nil {
+		return true
+	}
+	v, ok := r.cluster.current()
+	if !ok {
+		return true
+	}
+	if v.compare(r.min) >= 0 && (r.maxLen == 0 || v.truncate(r.maxLen).compare(r.max) <= 0) {
+		return true
+	}
+	r.skipped.Do(func() {
+		log.Warn("Metric ", r.name, " is not available in Couchbase ", v, " and won't be scraped")
+	})
+	return false
+}
+
+// clusterInfo holds the version of the cluster, read from /pools when the
+// exporter starts and again once the cluster can be reached after a failure,
+// and its name, read on every scrape.
+type clusterInfo struct {
+	context Context
+	desc    *p.Desc
+
+	mu      sync.RWMutex
+	known   bool
+	version version
+	labels  []string
+	name    string
+}
+
+// newClusterInfo creates the cluster information of the cluster of c.
+func newClusterInfo(c Context) *clusterInfo {
+	return &clusterInfo{
+		context: c,
+		desc: p.NewDesc("cb_cluster_info",
+			"Version, edition, UUID and name of the cluster. Always 1",
+			[]string{"version", "edition", "uuid", "name"}, nil),
+	}
+}
+
+// refresh reads the version of the cluster from /pools.
+func (i *clusterInfo) refresh(ctx context.Context) error {
+	body, err := Fetch(ctx, i.context, "/pools")
+	if err != nil {
+		return err
+	}
+	var pools struct {
+		ImplementationVersion string `json:"implementationVersion"`
+		IsEnterprise          bool   `json:"isEnterprise"`
+		UUID                  string `json:"uuid"`
+	}
+	err = json.Unmarshal(body, &pools)
+	if err != nil {
+		return err
+	}
+	v, _, err := parseVersion(pools.ImplementationVersion)
+	if err != nil {
+		return err
+	}
+	edition := "community"
+	if pools.IsEnterprise {
+		edition = "enterprise"
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.known || i.version != v {
+		log.Info("Couchbase version is ", pools.ImplementationVersion)
+	}
+	i.known = true
+	i.version = v
+	i.labels = []string{pools.ImplementationVersion, edition, pools.UUID}
+	return nil
+}
+
+// failed forgets the version of the cluster when a request to uri could not
+// connect to the management endpoint of the cluster, so that it is read again
+// on the next scrape, since the cluster may be upgraded. Requests to other
+// nodes, requests that timed out and canceled requests are ignored.
+func (i *clusterInfo) failed(uri string, err error) {
+	if i == nil || uri != i.context.URI || !connectionError(err) {
+		return
+	}
+	i.mu.Lock()
+	i.known = false
+	i.mu.Unlock()
+}
+
+// connectionError tells whether err is a failure to connect to or to talk
+// with a server, rather than a timeout or a cancellation.
+func connectionError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// current returns the version of the cluster, and false if it is unknown.
+func (i *clusterInfo) current() (version, bool) {
+	if i == nil {
+		return version{}, false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.version, i.known
+}
+
+// describe describes the cluster information metric.
+func (i *clusterInfo) describe(ch chan<- *p.Desc) {
+	ch <- i.desc
+}
+
+// readName reads the name of the cluster from /pools/default on every scrape,
+// since a cluster can be renamed at any time. The name is empty while the
+// cluster isn't initialized, and the last one read is kept when it can't be read.
+func (i *clusterInfo) readName(ctx context.Context) string {
+	var cluster struct {
+		ClusterName string `json:"clusterName"`
+	}
+	body, err := Fetch(ctx, i.context, "/pools/default")
+	if err == nil {
+		err = json.Unmarshal(body, &cluster)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err != nil {
+		log.Debug("Could not retrieve name of the cluster: ", err)
+		return i.name
+	}
+	i.name = cluster.ClusterName
+	return i.name
+}
+
+// collect exports the cluster information, reading the version first if it is unknown.
+func (i *clusterInfo) collect(ctx context.Context, ch chan<- p.Metric) {
+	if _, ok := i.current(); !ok {
+		if err := i.refresh(ctx); err != nil {
+			log.Error("Could not retrieve version of the cluster")
+			return
+		}
+	}
+	name := i.readName(ctx)
+	i.mu.RLock()
+	labels := append(append([]string{}, i.labels...), name)
+	i.mu.RUnlock()
+	ch <- p.MustNewConstMetric(i.desc, p.GaugeValue, 1, labels...)
+}
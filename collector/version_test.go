@@ -0,0 +1,206 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	p "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s       string
+		version version
+		n       int
+		err     bool
+	}{
+		{s: "7.0.2-6703-enterprise", version: version{7, 0, 2}, n: 3},
+		{s: "6.6.0-7909-community", version: version{6, 6, 0}, n: 3},
+		{s: "6.6", version: version{6, 6, 0}, n: 2},
+		{s: "7", version: version{7, 0, 0}, n: 1},
+		{s: "", err: true},
+		{s: "7.0.2.1", err: true},
+		{s: "7.x", err: true},
+		{s: "7.-1", err: true},
+		{s: "enterprise", err: true},
+	}
+	for _, test := range tests {
+		v, n, err := parseVersion(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("parseVersion(%q) error = %v, want error %v", test.s, err, test.err)
+			continue
+		}
+		if !test.err && (v != test.version || n != test.n) {
+			t.Errorf("parseVersion(%q) = %v, %d, want %v, %d", test.s, v, n, test.version, test.n)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		v    version
+		o    version
+		want int
+	}{
+		{v: version{7, 0, 2}, o: version{7, 0, 2}, want: 0},
+		{v: version{7, 0, 2}, o: version{7, 0, 0}, want: 1},
+		{v: version{6, 6, 5}, o: version{7, 0, 0}, want: -1},
+		{v: version{6, 10, 0}, o: version{6, 9, 9}, want: 1},
+		{v: version{5, 5, 0}, o: version{5, 5, 1}, want: -1},
+		{v: version{}, o: version{0, 0, 1}, want: -1},
+	}
+	for _, test := range tests {
+		if got := test.v.compare(test.o); got != test.want {
+			t.Errorf("%v.compare(%v) = %d, want %d", test.v, test.o, got, test.want)
+		}
+	}
+}
+
+func TestVersionTruncate(t *testing.T) {
+	tests := []struct {
+		v    version
+		n    int
+		want version
+	}{
+		{v: version{6, 6, 5}, n: 3, want: version{6, 6, 5}},
+		{v: version{6, 6, 5}, n: 2, want: version{6, 6, 0}},
+		{v: version{6, 6, 5}, n: 1, want: version{6, 0, 0}},
+		{v: version{6, 6, 5}, n: 0, want: version{}},
+	}
+	for _, test := range tests {
+		if got := test.v.truncate(test.n); got != test.want {
+			t.Errorf("%v.truncate(%d) = %v, want %v", test.v, test.n, got, test.want)
+		}
+	}
+}
+
+func TestVersionRangeSupported(t *testing.T) {
+	tests := []struct {
+		min     string
+		max     string
+		cluster string
+		want    bool
+	}{
+		{min: "7.0", cluster: "7.0.2-6703-enterprise", want: true},
+		{min: "7.0", cluster: "6.6.5-10080-enterprise", want: false},
+		{max: "6.6", cluster: "6.6.5-10080-enterprise", want: true},
+		{max: "6.6", cluster: "7.0.0-5302-enterprise", want: false},
+		{max: "4.6", cluster: "4.6.5-4742-enterprise", want: true},
+		{min: "5.0", max: "5.5", cluster: "5.5.6-5087-enterprise", want: true},
+		{min: "5.0", max: "5.5", cluster: "4.6.5-4742-enterprise", want: false},
+		{min: "7.0", cluster: "", want: true},
+	}
+	for _, test := range tests {
+		cluster := &clusterInfo{}
+		if test.cluster != "" {
+			v, _, err := parseVersion(test.cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cluster.known, cluster.version = true, v
+		}
+		r := newVersionRange(MetricDefinition{Name: "metric", MinVersion: test.min, MaxVersion: test.max}, cluster)
+		if got := r.supported(); got != test.want {
+			t.Errorf("range [%s, %s] supported by %q = %v, want %v", test.min, test.max, test.cluster, got, test.want)
+		}
+	}
+}
+
+func TestConnectionError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	client := &http.Client{Timeout: time.Millisecond}
+	_, refused := client.Get("http://127.0.0.1:1/pools")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial error", err: dialErr, want: true},
+		{name: "wrapped dial error", err: fmt.Errorf("get: %w", dialErr), want: true},
+		{name: "refused connection", err: refused, want: true},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "deadline exceeded", err: fmt.Errorf("get: %w", context.DeadlineExceeded), want: false},
+		{name: "timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, want: false},
+		{name: "status error", err: &HTTPStatusError{Code: 500}, want: false},
+	}
+	for _, test := range tests {
+		if got := connectionError(test.err); got != test.want {
+			t.Errorf("%s: connectionError(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+// timeoutError is a network error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClusterInfoFailed(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name  string
+		uri   string
+		err   error
+		known bool
+	}{
+		{name: "management endpoint unreachable", uri: "http://cb:8091", err: dialErr, known: false},
+		{name: "service node unreachable", uri: "http://cb:8096", err: dialErr, known: true},
+		{name: "management endpoint timeout", uri: "http://cb:8091", err: context.DeadlineExceeded, known: true},
+		{name: "management endpoint canceled", uri: "http://cb:8091", err: context.Canceled, known: true},
+	}
+	for _, test := range tests {
+		cluster := &clusterInfo{context: Context{URI: "http://cb:8091"}, known: true}
+		cluster.failed(test.uri, test.err)
+		if _, known := cluster.current(); known != test.known {
+			t.Errorf("%s: version known = %v, want %v", test.name, known, test.known)
+		}
+	}
+}
+
+func TestClusterInfoName(t *testing.T) {
+	var renamed int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"implementationVersion": "7.0.2-6703-enterprise", "isEnterprise": true, "uuid": "u"}`))
+		case "/pools/default":
+			if atomic.LoadInt32(&renamed) == 1 {
+				w.Write([]byte(`{"clusterName": "prod"}`))
+			} else {
+				w.Write([]byte(`{"clusterName": "staging"}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	cluster := newClusterInfo(Context{URI: server.URL, Timeout: time.Second})
+	scrape := scrapeFunc(func(ctx context.Context, ch chan<- p.Metric) error {
+		cluster.collect(ctx, ch)
+		return nil
+	})
+	for _, name := range []string{"staging", "prod"} {
+		values, err := scrapeMetrics(t, scrape)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `cb_cluster_info{edition="enterprise",name="` + name + `",uuid="u",version="7.0.2-6703-enterprise"}`
+		if _, ok := values[want]; !ok || len(values) != 1 {
+			t.Errorf("collect() exported %v, want %s", values, want)
+		}
+		atomic.StoreInt32(&renamed, 1)
+	}
+}
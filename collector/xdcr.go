@@ -5,6 +5,7 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -18,20 +19,25 @@ type XDCRExporter struct {
 	context    Context
 	route      string
 	errorCount *p.GaugeVec
-	metrics    map[string]*p.Desc
+	metrics    map[string]typedDesc
 }
 
 // NewXDCRExporter creates the XDCRExporter and fill it with metrics metadata from the metrics file.
 func NewXDCRExporter(c Context) (*XDCRExporter, error) {
-	xdcrMetrics, err := GetMetricsFromFile("xdcr")
+	xdcrMetrics, err := GetMetricsFromFile(c, "xdcr")
 	if err != nil {
 		return &XDCRExporter{}, err
 	}
 	// metrics is a map where the key is the metric ID and the value is a Prometheus Descriptor for that metric.
-	metrics := make(map[string]*p.Desc, len(xdcrMetrics.List))
+	metrics := make(map[string]typedDesc, len(xdcrMetrics.List))
 	for _, metric := range xdcrMetrics.List {
 		fqName := p.BuildFQName("cb", xdcrMetrics.Name, metric.Name)
-		metrics[metric.ID] = p.NewDesc(fqName, metric.Description, metric.Labels, nil)
+		desc := newTypedDesc(c, p.NewDesc(fqName, metric.Description, metric.Labels, nil), metric)
+		// Each XDCR stat is an array of samples of which the last one is exported.
+		if c.ScrapeSampleWindow {
+			desc = desc.withSampleWindow(fqName, metric.Description, metric.Labels)
+		}
+		metrics[metric.ID] = desc
 	}
 	return &XDCRExporter{
 		context: c,
@@ -48,17 +54,17 @@ func NewXDCRExporter(c Context) (*XDCRExporter, error) {
 func (e *XDCRExporter) Describe(ch chan<- *p.Desc) {
 	e.errorCount.Describe(ch)
 	for _, metric := range e.metrics {
-		ch <- metric
+		metric.describe(ch)
 	}
 }
 
-// Collect fetches data for each exported metric
-func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
+// Scrape fetches data for each exported metric
+func (e *XDCRExporter) Scrape(ctx context.Context, ch chan<- p.Metric) error {
 	// Get task list to retrieve active XDCR links.
-	body, err := Fetch(e.context, "/pools/default/tasks")
+	body, err := Fetch(ctx, e.context, "/pools/default/tasks")
 	if err != nil {
 		log.Error("Could not retrieve tasks data: XDCR metrics won't be scraped")
-		return
+		return err
 	}
 	var tasks []struct {
 		Type   string   `json:"type"`
@@ -69,7 +75,7 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 	err = json.Unmarshal(body, &tasks)
 	if err != nil {
 		log.Error("Could not unmarshal tasks data: XDCR metrics won't be scraped")
-		return
+		return err
 	}
 
 	var routes []string
@@ -93,7 +99,7 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 			errorsCount[uuid] = len(task.Errors)
 
 			// Associate remote clusters names with uuid for labelling.
-			body, err = Fetch(e.context, "/pools/default/remoteClusters")
+			body, err = Fetch(ctx, e.context, "/pools/default/remoteClusters")
 			if err != nil {
 				log.Error("Could not retrieve remote clusters data")
 			}
@@ -112,10 +118,10 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 	}
 
 	// Get hostname of the node.
-	body, err = Fetch(e.context, "/nodes/self")
+	body, err = Fetch(ctx, e.context, "/nodes/self")
 	if err != nil {
 		log.Error("Could not retrieve node data: XDCR metrics won't be scraped")
-		return
+		return err
 	}
 	var node struct {
 		Hostname string `json:"hostname"`
@@ -123,15 +129,20 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 	err = json.Unmarshal(body, &node)
 	if err != nil {
 		log.Error("Could not unmarshal node data: XDCR metrics won't be scraped")
-		return
+		return err
 	}
 
 	// Fetch all bodies from urls created above.
-	bodies := MultiFetch(e.context, routes)
+	bodies, errs := MultiFetch(ctx, e.context, routes)
 
 	// will store uuids that are already used for errorCount
 	done := make(map[string]bool)
 
+	// Routes that could not be fetched are logged by Fetch.
+	var scrapeErr error
+	for _, err := range errs {
+		scrapeErr = err
+	}
 	for route, body := range bodies {
 		// Split back url to get uuid src & dest buckets and metric name.
 		longID := strings.Split(route, "%2F")
@@ -144,6 +155,7 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 		err := json.Unmarshal(body, &xdcr)
 		if err != nil {
 			log.Error("Could not unmarshal XDCR data for remote " + uuid + " and metric " + metricID)
+			scrapeErr = err
 			continue
 		}
 		if _, ok := xdcr.NodeStats[node.Hostname].([]interface{}); !ok {
@@ -169,7 +181,12 @@ func (e *XDCRExporter) Collect(ch chan<- p.Metric) {
 			e.errorCount.WithLabelValues(uuid, remoteClusters[uuid], src, dest).Set(float64(errorsCount[uuid]))
 		}
 
-		ch <- p.MustNewConstMetric(e.metrics[metricID], p.GaugeValue, value, uuid, remoteClusters[uuid], src, dest)
+		metric := e.metrics[metricID]
+		if v, ok := metric.value(value); ok {
+			ch <- metric.mustNewConstMetric(v, uuid, remoteClusters[uuid], src, dest)
+		}
+		metric.collectWindow(ch, list, uuid, remoteClusters[uuid], src, dest)
 	}
 	e.errorCount.Collect(ch)
+	return scrapeErr
 }
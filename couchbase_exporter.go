@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
 	"os"
@@ -14,6 +15,8 @@ import (
 	"github.com/blakelead/couchbase_exporter/collector"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	p "github.com/prometheus/client_golang/prometheus"
+
 	cl "github.com/blakelead/confloader"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,11 +25,18 @@ import (
 type Options struct {
 	serverListenAddress string
 	serverMetricsPath   string
+	serverProbePath     string
 	serverTimeout       time.Duration
 	dbUsername          string
 	dbPassword          string
 	dbURI               string
 	dbTimeout           time.Duration
+	dbIdleConns         int
+	dbIdleConnsPerHost  int
+	dbMaxConcurrency    int
+	dbRateLimit         float64
+	dbRetries           int
+	dbRetryBackoff      time.Duration
 	tlsEnabled          bool
 	tlsSkipInsecure     bool
 	tlsCACert           string
@@ -34,11 +44,27 @@ type Options struct {
 	tlsClientKey        string
 	logLevel            string
 	logFormat           string
+	metricsDir          string
+	customMetrics       []collector.CustomMetrics
 	scrapeCluster       bool
 	scrapeNode          bool
+	scrapeAllNodes      bool
 	scrapeBucket        bool
+	scrapeBucketPerNode bool
 	scrapeXDCR          bool
+	scrapeQuery         bool
+	scrapeIndex         bool
+	scrapeFTS           bool
+	scrapeEventing      bool
+	scrapeAnalytics     bool
+	scrapeCollections   bool
+	scrapeSampleWindow  bool
+	scrapeInterval      time.Duration
+	scrapeMaxAge        time.Duration
 	configFile          string
+	modules             map[string]*Options
+	targets             []string
+	httpClient          *http.Client
 }
 
 var (
@@ -53,29 +79,47 @@ func main() {
 	initLogger()
 	displayInfo()
 
-	// Context encapsulates connection and scraping details for the exporters.
-	context := collector.Context{
-		URI:             runtimeOptions.dbURI,
-		Username:        runtimeOptions.dbUsername,
-		Password:        runtimeOptions.dbPassword,
-		Timeout:         runtimeOptions.dbTimeout,
-		TLSEnabled:      runtimeOptions.tlsEnabled,
-		TLSSkipInsecure: runtimeOptions.tlsSkipInsecure,
-		TLSCACert:       runtimeOptions.tlsCACert,
-		TLSClientCert:   runtimeOptions.tlsClientCert,
-		TLSClientKey:    runtimeOptions.tlsClientKey,
-		ScrapeCluster:   runtimeOptions.scrapeCluster,
-		ScrapeNode:      runtimeOptions.scrapeNode,
-		ScrapeBucket:    runtimeOptions.scrapeBucket,
-		ScrapeXDCR:      runtimeOptions.scrapeXDCR,
+	// Metrics and probe paths are handled separately.
+	if err := checkProbePath(runtimeOptions); err != nil {
+		log.Fatal("Invalid web.probe-path: ", err)
+	}
+
+	// HTTP clients are kept for the whole life of the exporter. Probed clusters
+	// share the client of their module, so connections are reused between probes.
+	runtimeOptions.httpClient = collector.NewHTTPClient(newContext(runtimeOptions, runtimeOptions.dbURI))
+	for _, module := range runtimeOptions.modules {
+		module.httpClient = collector.NewHTTPClient(newContext(module, ""))
 	}
 
 	// Exporters are initialized, meaning that metrics files are loaded and
 	// Exporter objects are created and filled with metrics metadata.
-	collector.InitExporters(context)
+	collectors := collector.NewCollectors(newContext(runtimeOptions, runtimeOptions.dbURI))
+
+	// The version of the cluster is read again on each scrape until it is known.
+	ctx, cancel := context.WithTimeout(context.Background(), runtimeOptions.dbTimeout)
+	if err := collectors.Refresh(ctx); err != nil {
+		log.Error("Could not retrieve version of the cluster: ", err)
+	}
+	cancel()
 
-	// Handle metrics path with the prometheus handler.
-	http.Handle(runtimeOptions.serverMetricsPath, promhttp.Handler())
+	// Handle metrics path: each request scrapes the exporters within the scrape timeout,
+	// unless exporters are scraped in the background, in which case the last scrape is served.
+	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, r, collectors, p.DefaultGatherer)
+	})
+	if runtimeOptions.scrapeInterval > 0 {
+		maxAge := runtimeOptions.scrapeMaxAge
+		if maxAge == 0 {
+			maxAge = 3 * runtimeOptions.scrapeInterval
+		}
+		cache := collector.NewCache(collectors, runtimeOptions.scrapeInterval, maxAge)
+		go cache.Run(context.Background())
+		metricsHandler = promhttp.HandlerFor(p.Gatherers{cache, p.DefaultGatherer}, promhttp.HandlerOpts{}).ServeHTTP
+	}
+	http.Handle(runtimeOptions.serverMetricsPath, promhttp.InstrumentMetricHandler(p.DefaultRegisterer, metricsHandler))
+
+	// Handle probe path: each request scrapes the cluster given as target.
+	http.HandleFunc(runtimeOptions.serverProbePath, probeHandler)
 
 	// Handle paths other than given metrics path.
 	if runtimeOptions.serverMetricsPath != "/" {
@@ -107,13 +151,88 @@ func FlagPresent(name string) bool {
 	return found
 }
 
+// newContext creates the exporters context for the cluster
+// located at uri, using connection details from options o.
+func newContext(o *Options, uri string) collector.Context {
+	return collector.Context{
+		URI:                 uri,
+		Username:            o.dbUsername,
+		Password:            o.dbPassword,
+		Timeout:             o.dbTimeout,
+		MaxIdleConns:        o.dbIdleConns,
+		MaxIdleConnsPerHost: o.dbIdleConnsPerHost,
+		MaxConcurrency:      o.dbMaxConcurrency,
+		RateLimit:           o.dbRateLimit,
+		Retries:             o.dbRetries,
+		RetryBackoff:        o.dbRetryBackoff,
+		Client:              o.httpClient,
+		TLSEnabled:          o.tlsEnabled,
+		TLSSkipInsecure:     o.tlsSkipInsecure,
+		TLSCACert:           o.tlsCACert,
+		TLSClientCert:       o.tlsClientCert,
+		TLSClientKey:        o.tlsClientKey,
+		MetricsDir:          o.metricsDir,
+		CustomMetrics:       o.customMetrics,
+		ScrapeCluster:       o.scrapeCluster,
+		ScrapeNode:          o.scrapeNode,
+		ScrapeAllNodes:      o.scrapeAllNodes,
+		ScrapeBucket:        o.scrapeBucket,
+		ScrapeBucketPerNode: o.scrapeBucketPerNode,
+		ScrapeXDCR:          o.scrapeXDCR,
+		ScrapeQuery:         o.scrapeQuery,
+		ScrapeIndex:         o.scrapeIndex,
+		ScrapeFTS:           o.scrapeFTS,
+		ScrapeEventing:      o.scrapeEventing,
+		ScrapeAnalytics:     o.scrapeAnalytics,
+		ScrapeCollections:   o.scrapeCollections,
+		ScrapeSampleWindow:  o.scrapeSampleWindow,
+	}
+}
+
+// scrapeTimeoutOffset is subtracted from the scrape timeout of Prometheus
+// to leave time to send the response.
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// scrapeContext returns the context of the scrape requested by r. It is canceled
+// when the client goes away, and expires before Prometheus gives up on the scrape,
+// as told by the X-Prometheus-Scrape-Timeout-Seconds header of r.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// serveMetrics scrapes collectors within the scrape timeout of the request
+// and serves their metrics along with the ones of gatherers.
+func serveMetrics(w http.ResponseWriter, r *http.Request, collectors *collector.Collectors, gatherers ...p.Gatherer) {
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+
+	registry := p.NewRegistry()
+	registry.MustRegister(collectors.Bind(ctx))
+	promhttp.HandlerFor(append(p.Gatherers{registry}, gatherers...), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
 func initEnv() {
 	// Default parameters.
 	runtimeOptions.serverListenAddress = "127.0.0.1:9191"
 	runtimeOptions.serverMetricsPath = "/metrics"
+	runtimeOptions.serverProbePath = "/probe"
 	runtimeOptions.serverTimeout = 10 * time.Second
 	runtimeOptions.dbURI = "http://localhost:8091"
 	runtimeOptions.dbTimeout = 10 * time.Second
+	runtimeOptions.dbIdleConns = 100
+	runtimeOptions.dbIdleConnsPerHost = 20
+	runtimeOptions.dbMaxConcurrency = 10
+	runtimeOptions.dbRateLimit = 0
+	runtimeOptions.dbRetries = 2
+	runtimeOptions.dbRetryBackoff = 100 * time.Millisecond
 	runtimeOptions.tlsEnabled = false
 	runtimeOptions.tlsSkipInsecure = false
 	runtimeOptions.tlsCACert = ""
@@ -121,10 +240,22 @@ func initEnv() {
 	runtimeOptions.tlsClientKey = ""
 	runtimeOptions.logLevel = "info"
 	runtimeOptions.logFormat = "text"
+	runtimeOptions.metricsDir = ""
 	runtimeOptions.scrapeCluster = true
 	runtimeOptions.scrapeNode = true
+	runtimeOptions.scrapeAllNodes = false
 	runtimeOptions.scrapeBucket = true
+	runtimeOptions.scrapeBucketPerNode = false
 	runtimeOptions.scrapeXDCR = true
+	runtimeOptions.scrapeQuery = false
+	runtimeOptions.scrapeIndex = false
+	runtimeOptions.scrapeFTS = false
+	runtimeOptions.scrapeEventing = false
+	runtimeOptions.scrapeAnalytics = false
+	runtimeOptions.scrapeCollections = false
+	runtimeOptions.scrapeSampleWindow = false
+	runtimeOptions.scrapeInterval = 0
+	runtimeOptions.scrapeMaxAge = 0
 	runtimeOptions.configFile = ""
 
 	// Get command-line values.
@@ -132,9 +263,16 @@ func initEnv() {
 	flag.StringVar(&cmdlineOptions.configFile, "config.file", runtimeOptions.configFile, "Path to configuration file.")
 	flag.StringVar(&cmdlineOptions.serverListenAddress, "web.listen-address", runtimeOptions.serverListenAddress, "Address to listen on for HTTP requests.")
 	flag.StringVar(&cmdlineOptions.serverMetricsPath, "web.telemetry-path", runtimeOptions.serverMetricsPath, "Path under which to expose metrics.")
+	flag.StringVar(&cmdlineOptions.serverProbePath, "web.probe-path", runtimeOptions.serverProbePath, "Path under which to expose metrics of probed clusters.")
 	flag.DurationVar(&cmdlineOptions.serverTimeout, "web.timeout", runtimeOptions.serverTimeout, "Server read timeout in seconds.")
 	flag.StringVar(&cmdlineOptions.dbURI, "db.uri", runtimeOptions.dbURI, "Couchbase node URI with port.")
 	flag.DurationVar(&cmdlineOptions.dbTimeout, "db.timeout", runtimeOptions.dbTimeout, "Couchbase client timeout in seconds.")
+	flag.IntVar(&cmdlineOptions.dbIdleConns, "db.idle-conns", runtimeOptions.dbIdleConns, "Maximum number of idle connections kept open to Couchbase.")
+	flag.IntVar(&cmdlineOptions.dbIdleConnsPerHost, "db.idle-conns-per-host", runtimeOptions.dbIdleConnsPerHost, "Maximum number of idle connections kept open to each Couchbase node.")
+	flag.IntVar(&cmdlineOptions.dbMaxConcurrency, "db.max-concurrency", runtimeOptions.dbMaxConcurrency, "Maximum number of concurrent requests of a collector. 0 means unlimited.")
+	flag.Float64Var(&cmdlineOptions.dbRateLimit, "db.rate-limit", runtimeOptions.dbRateLimit, "Maximum number of requests per second to the cluster. 0 means unlimited.")
+	flag.IntVar(&cmdlineOptions.dbRetries, "db.retries", runtimeOptions.dbRetries, "Number of retries of failed requests to Couchbase.")
+	flag.DurationVar(&cmdlineOptions.dbRetryBackoff, "db.retry-backoff", runtimeOptions.dbRetryBackoff, "Wait before the first retry of a request, doubled for each retry.")
 	flag.BoolVar(&cmdlineOptions.tlsEnabled, "tls.enabled", runtimeOptions.tlsEnabled, "If true, TLS is used when communicating with cluster.")
 	flag.BoolVar(&cmdlineOptions.tlsSkipInsecure, "tls.skip-insecure", runtimeOptions.tlsSkipInsecure, "If true, certificate won't be verified.")
 	flag.StringVar(&cmdlineOptions.tlsCACert, "tls.ca-cert", runtimeOptions.tlsCACert, "Root certificate of the cluster.")
@@ -142,12 +280,25 @@ func initEnv() {
 	flag.StringVar(&cmdlineOptions.tlsClientKey, "tls.client-key", runtimeOptions.tlsClientKey, "Client private key.")
 	flag.StringVar(&cmdlineOptions.logLevel, "log.level", runtimeOptions.logLevel, "Log level: info, debug, warn, error, fatal.")
 	flag.StringVar(&cmdlineOptions.logFormat, "log.format", runtimeOptions.logFormat, "Log format: text or json.")
+	flag.StringVar(&cmdlineOptions.metricsDir, "metrics.dir", runtimeOptions.metricsDir, "Directory of metrics files overriding the embedded ones.")
 	flag.BoolVar(&cmdlineOptions.scrapeCluster, "scrape.cluster", runtimeOptions.scrapeCluster, "If false, cluster metrics won't be scraped.")
 	flag.BoolVar(&cmdlineOptions.scrapeNode, "scrape.node", runtimeOptions.scrapeNode, "If false, node metrics won't be scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeAllNodes, "scrape.all-nodes", runtimeOptions.scrapeAllNodes, "If true, metrics of every node of the cluster are scraped instead of only the target node.")
 	flag.BoolVar(&cmdlineOptions.scrapeBucket, "scrape.bucket", runtimeOptions.scrapeBucket, "If false, bucket metrics won't be scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeBucketPerNode, "scrape.bucket-per-node", runtimeOptions.scrapeBucketPerNode, "If true, bucket stats are scraped for each node instead of for the whole cluster.")
 	flag.BoolVar(&cmdlineOptions.scrapeXDCR, "scrape.xdcr", runtimeOptions.scrapeXDCR, "If false, XDCR metrics won't be scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeQuery, "scrape.query", runtimeOptions.scrapeQuery, "If true, query service metrics are scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeIndex, "scrape.index", runtimeOptions.scrapeIndex, "If true, index service metrics are scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeFTS, "scrape.fts", runtimeOptions.scrapeFTS, "If true, full text search metrics are scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeEventing, "scrape.eventing", runtimeOptions.scrapeEventing, "If true, eventing service metrics are scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeAnalytics, "scrape.analytics", runtimeOptions.scrapeAnalytics, "If true, analytics service metrics are scraped.")
+	flag.BoolVar(&cmdlineOptions.scrapeCollections, "scrape.collections", runtimeOptions.scrapeCollections, "If true, scopes and collections metrics are scraped (Couchbase 7+).")
+	flag.BoolVar(&cmdlineOptions.scrapeSampleWindow, "scrape.sample-window", runtimeOptions.scrapeSampleWindow, "If true, minimum, maximum and average of stats samples are scraped along with the last sample.")
+	flag.DurationVar(&cmdlineOptions.scrapeInterval, "scrape.interval", runtimeOptions.scrapeInterval, "If set, the cluster is scraped in the background at this interval and the last scrape is served.")
+	flag.DurationVar(&cmdlineOptions.scrapeMaxAge, "scrape.max-age", runtimeOptions.scrapeMaxAge, "Age after which metrics scraped in the background are dropped. Defaults to 3 intervals.")
 	flag.Parse()
 
+	var loadedConfig cl.Config
 	configFileProvided := FlagPresent("config.file")
 	configLocations := [4]string{cmdlineOptions.configFile, "config.json", "config.yml", "config.yaml"}
 	for idx, configLocation := range configLocations {
@@ -164,6 +315,9 @@ func initEnv() {
 		if config.GetString("web.telemetryPath") != "" {
 			runtimeOptions.serverMetricsPath = config.GetString("web.telemetryPath")
 		}
+		if config.GetString("web.probePath") != "" {
+			runtimeOptions.serverProbePath = config.GetString("web.probePath")
+		}
 		if config.GetDuration("web.timeout") != 0*time.Second {
 			runtimeOptions.serverTimeout = config.GetDuration("web.timeout")
 		}
@@ -179,6 +333,24 @@ func initEnv() {
 		if config.GetDuration("db.timeout") != 0*time.Second {
 			runtimeOptions.dbTimeout = config.GetDuration("db.timeout")
 		}
+		if config.GetInt("db.idle-conns") != 0 {
+			runtimeOptions.dbIdleConns = config.GetInt("db.idle-conns")
+		}
+		if config.GetInt("db.idle-conns-per-host") != 0 {
+			runtimeOptions.dbIdleConnsPerHost = config.GetInt("db.idle-conns-per-host")
+		}
+		if config.GetInt("db.max-concurrency") != 0 {
+			runtimeOptions.dbMaxConcurrency = config.GetInt("db.max-concurrency")
+		}
+		if config.GetFloat("db.rate-limit") != 0 {
+			runtimeOptions.dbRateLimit = config.GetFloat("db.rate-limit")
+		}
+		if config.Get("db.retries") != nil {
+			runtimeOptions.dbRetries = config.GetInt("db.retries")
+		}
+		if config.GetDuration("db.retry-backoff") != 0*time.Second {
+			runtimeOptions.dbRetryBackoff = config.GetDuration("db.retry-backoff")
+		}
 		if config.GetBool("tls.enabled") != runtimeOptions.tlsEnabled {
 			runtimeOptions.tlsEnabled = config.GetBool("tls.enabled")
 		}
@@ -200,21 +372,58 @@ func initEnv() {
 		if config.GetString("log.format") != "" {
 			runtimeOptions.logFormat = config.GetString("log.format")
 		}
+		if config.GetString("metrics.dir") != "" {
+			runtimeOptions.metricsDir = config.GetString("metrics.dir")
+		}
 		if config.GetBool("scrape.cluster") != runtimeOptions.scrapeCluster {
 			runtimeOptions.scrapeCluster = config.GetBool("scrape.cluster")
 		}
 		if config.GetBool("scrape.node") != runtimeOptions.scrapeNode {
 			runtimeOptions.scrapeNode = config.GetBool("scrape.node")
 		}
+		if config.GetBool("scrape.all-nodes") != runtimeOptions.scrapeAllNodes {
+			runtimeOptions.scrapeAllNodes = config.GetBool("scrape.all-nodes")
+		}
 		if config.GetBool("scrape.bucket") != runtimeOptions.scrapeBucket {
 			runtimeOptions.scrapeBucket = config.GetBool("scrape.bucket")
 		}
+		if config.GetBool("scrape.bucket-per-node") != runtimeOptions.scrapeBucketPerNode {
+			runtimeOptions.scrapeBucketPerNode = config.GetBool("scrape.bucket-per-node")
+		}
 		if config.GetBool("scrape.xdcr") != runtimeOptions.scrapeXDCR {
 			runtimeOptions.scrapeXDCR = config.GetBool("scrape.xdcr")
 		}
+		if config.GetBool("scrape.query") != runtimeOptions.scrapeQuery {
+			runtimeOptions.scrapeQuery = config.GetBool("scrape.query")
+		}
+		if config.GetBool("scrape.index") != runtimeOptions.scrapeIndex {
+			runtimeOptions.scrapeIndex = config.GetBool("scrape.index")
+		}
+		if config.GetBool("scrape.fts") != runtimeOptions.scrapeFTS {
+			runtimeOptions.scrapeFTS = config.GetBool("scrape.fts")
+		}
+		if config.GetBool("scrape.eventing") != runtimeOptions.scrapeEventing {
+			runtimeOptions.scrapeEventing = config.GetBool("scrape.eventing")
+		}
+		if config.GetBool("scrape.analytics") != runtimeOptions.scrapeAnalytics {
+			runtimeOptions.scrapeAnalytics = config.GetBool("scrape.analytics")
+		}
+		if config.GetBool("scrape.collections") != runtimeOptions.scrapeCollections {
+			runtimeOptions.scrapeCollections = config.GetBool("scrape.collections")
+		}
+		if config.GetBool("scrape.sample-window") != runtimeOptions.scrapeSampleWindow {
+			runtimeOptions.scrapeSampleWindow = config.GetBool("scrape.sample-window")
+		}
+		if config.GetDuration("scrape.interval") != 0*time.Second {
+			runtimeOptions.scrapeInterval = config.GetDuration("scrape.interval")
+		}
+		if config.GetDuration("scrape.max-age") != 0*time.Second {
+			runtimeOptions.scrapeMaxAge = config.GetDuration("scrape.max-age")
+		}
 
 		// Stop on first encounter
 		runtimeOptions.configFile = configLocation
+		loadedConfig = config
 		break
 	}
 
@@ -225,6 +434,9 @@ func initEnv() {
 	if val, ok := os.LookupEnv("CB_EXPORTER_TELEMETRY_PATH"); ok {
 		runtimeOptions.serverMetricsPath = val
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_PROBE_PATH"); ok {
+		runtimeOptions.serverProbePath = val
+	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_SERVER_TIMEOUT"); ok {
 		runtimeOptions.serverTimeout, _ = time.ParseDuration(val)
 	}
@@ -240,6 +452,24 @@ func initEnv() {
 	if val, ok := os.LookupEnv("CB_EXPORTER_DB_TIMEOUT"); ok {
 		runtimeOptions.dbTimeout, _ = time.ParseDuration(val)
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_IDLE_CONNS"); ok {
+		runtimeOptions.dbIdleConns, _ = strconv.Atoi(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_IDLE_CONNS_PER_HOST"); ok {
+		runtimeOptions.dbIdleConnsPerHost, _ = strconv.Atoi(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_MAX_CONCURRENCY"); ok {
+		runtimeOptions.dbMaxConcurrency, _ = strconv.Atoi(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_RATE_LIMIT"); ok {
+		runtimeOptions.dbRateLimit, _ = strconv.ParseFloat(val, 64)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_RETRIES"); ok {
+		runtimeOptions.dbRetries, _ = strconv.Atoi(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_DB_RETRY_BACKOFF"); ok {
+		runtimeOptions.dbRetryBackoff, _ = time.ParseDuration(val)
+	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_TLS_ENABLED"); ok {
 		runtimeOptions.tlsEnabled, _ = strconv.ParseBool(val)
 	}
@@ -261,18 +491,54 @@ func initEnv() {
 	if val, ok := os.LookupEnv("CB_EXPORTER_LOG_FORMAT"); ok {
 		runtimeOptions.logFormat = val
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_METRICS_DIR"); ok {
+		runtimeOptions.metricsDir = val
+	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_CLUSTER"); ok {
 		runtimeOptions.scrapeCluster, _ = strconv.ParseBool(val)
 	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_NODE"); ok {
 		runtimeOptions.scrapeNode, _ = strconv.ParseBool(val)
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_ALL_NODES"); ok {
+		runtimeOptions.scrapeAllNodes, _ = strconv.ParseBool(val)
+	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_BUCKET"); ok {
 		runtimeOptions.scrapeBucket, _ = strconv.ParseBool(val)
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_BUCKET_PER_NODE"); ok {
+		runtimeOptions.scrapeBucketPerNode, _ = strconv.ParseBool(val)
+	}
 	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_XDCR"); ok {
 		runtimeOptions.scrapeXDCR, _ = strconv.ParseBool(val)
 	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_QUERY"); ok {
+		runtimeOptions.scrapeQuery, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_INDEX"); ok {
+		runtimeOptions.scrapeIndex, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_FTS"); ok {
+		runtimeOptions.scrapeFTS, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_EVENTING"); ok {
+		runtimeOptions.scrapeEventing, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_ANALYTICS"); ok {
+		runtimeOptions.scrapeAnalytics, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_COLLECTIONS"); ok {
+		runtimeOptions.scrapeCollections, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_SAMPLE_WINDOW"); ok {
+		runtimeOptions.scrapeSampleWindow, _ = strconv.ParseBool(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_INTERVAL"); ok {
+		runtimeOptions.scrapeInterval, _ = time.ParseDuration(val)
+	}
+	if val, ok := os.LookupEnv("CB_EXPORTER_SCRAPE_MAX_AGE"); ok {
+		runtimeOptions.scrapeMaxAge, _ = time.ParseDuration(val)
+	}
 
 	// Command-line values
 	if FlagPresent("web.listen-address") {
@@ -281,6 +547,9 @@ func initEnv() {
 	if FlagPresent("web.telemetry-path") {
 		runtimeOptions.serverMetricsPath = cmdlineOptions.serverMetricsPath
 	}
+	if FlagPresent("web.probe-path") {
+		runtimeOptions.serverProbePath = cmdlineOptions.serverProbePath
+	}
 	if FlagPresent("web.timeout") {
 		runtimeOptions.serverTimeout = cmdlineOptions.serverTimeout
 	}
@@ -296,6 +565,24 @@ func initEnv() {
 	if FlagPresent("db.timeout") {
 		runtimeOptions.dbTimeout = cmdlineOptions.dbTimeout
 	}
+	if FlagPresent("db.idle-conns") {
+		runtimeOptions.dbIdleConns = cmdlineOptions.dbIdleConns
+	}
+	if FlagPresent("db.idle-conns-per-host") {
+		runtimeOptions.dbIdleConnsPerHost = cmdlineOptions.dbIdleConnsPerHost
+	}
+	if FlagPresent("db.max-concurrency") {
+		runtimeOptions.dbMaxConcurrency = cmdlineOptions.dbMaxConcurrency
+	}
+	if FlagPresent("db.rate-limit") {
+		runtimeOptions.dbRateLimit = cmdlineOptions.dbRateLimit
+	}
+	if FlagPresent("db.retries") {
+		runtimeOptions.dbRetries = cmdlineOptions.dbRetries
+	}
+	if FlagPresent("db.retry-backoff") {
+		runtimeOptions.dbRetryBackoff = cmdlineOptions.dbRetryBackoff
+	}
 	if FlagPresent("tls.enabled") {
 		runtimeOptions.tlsEnabled = cmdlineOptions.tlsEnabled
 	}
@@ -317,18 +604,61 @@ func initEnv() {
 	if FlagPresent("log.format") {
 		runtimeOptions.logFormat = cmdlineOptions.logFormat
 	}
+	if FlagPresent("metrics.dir") {
+		runtimeOptions.metricsDir = cmdlineOptions.metricsDir
+	}
 	if FlagPresent("scrape.cluster") {
 		runtimeOptions.scrapeCluster = cmdlineOptions.scrapeCluster
 	}
 	if FlagPresent("scrape.node") {
 		runtimeOptions.scrapeNode = cmdlineOptions.scrapeNode
 	}
+	if FlagPresent("scrape.all-nodes") {
+		runtimeOptions.scrapeAllNodes = cmdlineOptions.scrapeAllNodes
+	}
 	if FlagPresent("scrape.bucket") {
 		runtimeOptions.scrapeBucket = cmdlineOptions.scrapeBucket
 	}
+	if FlagPresent("scrape.bucket-per-node") {
+		runtimeOptions.scrapeBucketPerNode = cmdlineOptions.scrapeBucketPerNode
+	}
 	if FlagPresent("scrape.xdcr") {
 		runtimeOptions.scrapeXDCR = cmdlineOptions.scrapeXDCR
 	}
+	if FlagPresent("scrape.query") {
+		runtimeOptions.scrapeQuery = cmdlineOptions.scrapeQuery
+	}
+	if FlagPresent("scrape.index") {
+		runtimeOptions.scrapeIndex = cmdlineOptions.scrapeIndex
+	}
+	if FlagPresent("scrape.fts") {
+		runtimeOptions.scrapeFTS = cmdlineOptions.scrapeFTS
+	}
+	if FlagPresent("scrape.eventing") {
+		runtimeOptions.scrapeEventing = cmdlineOptions.scrapeEventing
+	}
+	if FlagPresent("scrape.analytics") {
+		runtimeOptions.scrapeAnalytics = cmdlineOptions.scrapeAnalytics
+	}
+	if FlagPresent("scrape.collections") {
+		runtimeOptions.scrapeCollections = cmdlineOptions.scrapeCollections
+	}
+	if FlagPresent("scrape.sample-window") {
+		runtimeOptions.scrapeSampleWindow = cmdlineOptions.scrapeSampleWindow
+	}
+	if FlagPresent("scrape.interval") {
+		runtimeOptions.scrapeInterval = cmdlineOptions.scrapeInterval
+	}
+	if FlagPresent("scrape.max-age") {
+		runtimeOptions.scrapeMaxAge = cmdlineOptions.scrapeMaxAge
+	}
+
+	// Custom metrics sets can only be declared in the configuration file.
+	runtimeOptions.customMetrics = loadCustomMetrics(loadedConfig)
+
+	// Modules inherit values defined above and override them
+	// with their own section of the configuration file.
+	runtimeOptions.modules = loadModules(loadedConfig, runtimeOptions)
 }
 
 func initLogger() {
@@ -363,9 +693,16 @@ func displayInfo() {
 	log.Info("config.file=", runtimeOptions.configFile)
 	log.Info("web.listen-address=", runtimeOptions.serverListenAddress)
 	log.Info("web.telemetry-path=", runtimeOptions.serverMetricsPath)
+	log.Info("web.probe-path=", runtimeOptions.serverProbePath)
 	log.Info("web.timeout=", runtimeOptions.serverTimeout)
 	log.Info("db.uri=", runtimeOptions.dbURI)
 	log.Info("db.timeout=", runtimeOptions.dbTimeout)
+	log.Info("db.idle-conns=", runtimeOptions.dbIdleConns)
+	log.Info("db.idle-conns-per-host=", runtimeOptions.dbIdleConnsPerHost)
+	log.Info("db.max-concurrency=", runtimeOptions.dbMaxConcurrency)
+	log.Info("db.rate-limit=", runtimeOptions.dbRateLimit)
+	log.Info("db.retries=", runtimeOptions.dbRetries)
+	log.Info("db.retry-backoff=", runtimeOptions.dbRetryBackoff)
 	log.Info("tls.skip-insecure=", runtimeOptions.tlsSkipInsecure)
 	log.Info("tls.ca-cert=", runtimeOptions.tlsCACert)
 	log.Info("tls.enabled=", runtimeOptions.tlsEnabled)
@@ -373,8 +710,23 @@ func displayInfo() {
 	log.Info("tls.client-key=", runtimeOptions.tlsClientKey)
 	log.Info("log.level=", runtimeOptions.logLevel)
 	log.Info("log.format=", runtimeOptions.logFormat)
+	log.Info("metrics.dir=", runtimeOptions.metricsDir)
 	log.Info("scrape.cluster=", runtimeOptions.scrapeCluster)
 	log.Info("scrape.node=", runtimeOptions.scrapeNode)
+	log.Info("scrape.all-nodes=", runtimeOptions.scrapeAllNodes)
 	log.Info("scrape.bucket=", runtimeOptions.scrapeBucket)
+	log.Info("scrape.bucket-per-node=", runtimeOptions.scrapeBucketPerNode)
 	log.Info("scrape.xdcr=", runtimeOptions.scrapeXDCR)
+	log.Info("scrape.query=", runtimeOptions.scrapeQuery)
+	log.Info("scrape.index=", runtimeOptions.scrapeIndex)
+	log.Info("scrape.fts=", runtimeOptions.scrapeFTS)
+	log.Info("scrape.eventing=", runtimeOptions.scrapeEventing)
+	log.Info("scrape.analytics=", runtimeOptions.scrapeAnalytics)
+	log.Info("scrape.collections=", runtimeOptions.scrapeCollections)
+	log.Info("scrape.sample-window=", runtimeOptions.scrapeSampleWindow)
+	log.Info("scrape.interval=", runtimeOptions.scrapeInterval)
+	log.Info("scrape.max-age=", runtimeOptions.scrapeMaxAge)
+	for name := range runtimeOptions.modules {
+		log.Info("module=", name)
+	}
 }
@@ -0,0 +1,74 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blakelead/couchbase_exporter/collector"
+
+	cl "github.com/blakelead/confloader"
+)
+
+// loadCustomMetrics reads the custom section of the configuration file. Each
+// entry declares a metrics set with a route and a list of metrics.
+func loadCustomMetrics(config cl.Config) []collector.CustomMetrics {
+	var customMetrics []collector.CustomMetrics
+	for _, name := range subKeys(config, "custom.") {
+		prefix := "custom." + name + "."
+		metrics := collector.CustomMetrics{
+			Name:  name,
+			Route: config.GetString(prefix + "route"),
+		}
+		for i := 0; ; i++ {
+			item := prefix + "list." + strconv.Itoa(i) + "."
+			if len(subKeys(config, item)) == 0 {
+				break
+			}
+			metric := collector.CustomMetricDefinition{
+				Each:       config.GetString(item + "each"),
+				LabelPaths: make(map[string]string),
+			}
+			metric.Name = config.GetString(item + "name")
+			metric.ID = config.GetString(item + "id")
+			metric.Description = config.GetString(item + "description")
+			metric.Type = config.GetString(item + "type")
+			metric.Scale = config.GetFloat(item + "scale")
+			metric.Unit = config.GetString(item + "unit")
+			for _, label := range subKeys(config, item+"labels.") {
+				metric.LabelPaths[label] = config.GetString(item + "labels." + label)
+			}
+			for _, value := range subKeys(config, item+"enum.") {
+				if metric.Enum == nil {
+					metric.Enum = make(map[string]float64)
+				}
+				metric.Enum[value] = config.GetFloat(item + "enum." + value)
+			}
+			metrics.List = append(metrics.List, metric)
+		}
+		customMetrics = append(customMetrics, metrics)
+	}
+	return customMetrics
+}
+
+// subKeys returns the sorted names of the parameters found right under prefix.
+func subKeys(config cl.Config, prefix string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for key := range config {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, prefix), ".", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
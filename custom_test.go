@@ -0,0 +1,50 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blakelead/couchbase_exporter/collector"
+
+	cl "github.com/blakelead/confloader"
+)
+
+func TestLoadCustomMetrics(t *testing.T) {
+	config := cl.Config{
+		"custom.scopes.route":                 "/pools/default/buckets/{bucket}/scopes",
+		"custom.scopes.list.0.name":           "collections",
+		"custom.scopes.list.0.id":             "collections",
+		"custom.scopes.list.0.each":           "scopes",
+		"custom.scopes.list.0.labels.scope":   "name",
+		"custom.scopes.list.1.name":           "status",
+		"custom.scopes.list.1.id":             "status",
+		"custom.scopes.list.1.enum.healthy":   1.0,
+		"custom.scopes.list.1.enum.unhealthy": 0.0,
+		"custom.autocompaction.route":         "/settings/autoCompaction",
+		"custom.autocompaction.list.0.name":   "purge_interval_days",
+		"custom.autocompaction.list.0.id":     "purgeInterval",
+		"custom.autocompaction.list.0.unit":   "days",
+		"custom.autocompaction.list.0.scale":  1.5,
+		"modules.prod.targets":                "cb-prod:8091",
+	}
+	got := loadCustomMetrics(config)
+
+	collections := collector.CustomMetricDefinition{Each: "scopes", LabelPaths: map[string]string{"scope": "name"}}
+	collections.Name, collections.ID = "collections", "collections"
+	status := collector.CustomMetricDefinition{LabelPaths: map[string]string{}}
+	status.Name, status.ID, status.Enum = "status", "status", map[string]float64{"healthy": 1, "unhealthy": 0}
+	purge := collector.CustomMetricDefinition{LabelPaths: map[string]string{}}
+	purge.Name, purge.ID, purge.Unit, purge.Scale = "purge_interval_days", "purgeInterval", "days", 1.5
+
+	want := []collector.CustomMetrics{
+		{Name: "autocompaction", Route: "/settings/autoCompaction", List: []collector.CustomMetricDefinition{purge}},
+		{Name: "scopes", Route: "/pools/default/buckets/{bucket}/scopes", List: []collector.CustomMetricDefinition{collections, status}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadCustomMetrics() = %+v, want %+v", got, want)
+	}
+}
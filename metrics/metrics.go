@@ -0,0 +1,14 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+// Package metrics holds the default metrics definition files,
+// compiled into the binary so that it can run on its own.
+package metrics
+
+import "embed"
+
+// Files contains the <type>.json metrics definition files.
+//
+//go:embed *.json
+var Files embed.FS
@@ -0,0 +1,233 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blakelead/couchbase_exporter/collector"
+
+	cl "github.com/blakelead/confloader"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeCollectors holds the collectors of each probed cluster, by module and
+// target. They are created on the first probe and kept afterwards, so that
+// metrics files are loaded once and counters and rate limits apply across
+// probes. Targets must be listed in their module, which bounds the cache.
+var (
+	probeCollectorsMu sync.Mutex
+	probeCollectors   = make(map[string]*collector.Collectors)
+)
+
+// probeHandler scrapes the cluster given by the target parameter with the
+// settings of the module given by the module parameter. The target must be
+// one of the targets of the module, so that its credentials aren't sent to
+// other hosts.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("module")
+	if name == "" {
+		http.Error(w, "Module parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module, ok := runtimeOptions.modules[name]
+	if !ok {
+		http.Error(w, "Unknown module "+name, http.StatusBadRequest)
+		return
+	}
+
+	target = targetURI(target, module.tlsEnabled)
+	collectors, ok := probeCollectorsFor(name, target, module)
+	if !ok {
+		http.Error(w, "Target "+target+" is not allowed for module "+name, http.StatusForbidden)
+		return
+	}
+
+	log.Debug("Probing ", target)
+
+	serveMetrics(w, r, collectors)
+}
+
+// checkProbePath returns an error if the probe path of o is also used for
+// the metrics of the exporter or for its home page, since a path can only
+// be handled once.
+func checkProbePath(o *Options) error {
+	if o.serverProbePath == o.serverMetricsPath {
+		return fmt.Errorf("probe path %s is also the metrics path", o.serverProbePath)
+	}
+	if o.serverProbePath == "/" {
+		return fmt.Errorf("probe path can't be /")
+	}
+	return nil
+}
+
+// targetURI adds a scheme to target if it has none, since targets can be
+// given without scheme, like blackbox exporter targets.
+func targetURI(target string, tlsEnabled bool) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+	if tlsEnabled {
+		return "https://" + target
+	}
+	return "http://" + target
+}
+
+// probeCollectorsFor returns the collectors of target probed with module,
+// creating them on first use. It returns false if target isn't one of the
+// targets of module.
+func probeCollectorsFor(name, target string, module *Options) (*collector.Collectors, bool) {
+	allowed := false
+	for _, t := range module.targets {
+		if t == target {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, false
+	}
+
+	probeCollectorsMu.Lock()
+	defer probeCollectorsMu.Unlock()
+	key := name + "|" + target
+	collectors, ok := probeCollectors[key]
+	if !ok {
+		collectors = collector.NewCollectors(newContext(module, target))
+		probeCollectors[key] = collectors
+	}
+	return collectors, true
+}
+
+// loadModules reads the modules section of the configuration file. Each module
+// starts as a copy of the defaults and overrides TLS settings and scrape toggles
+// with its own values. Credentials are never inherited, so that the credentials
+// of the main cluster aren't sent to probed clusters: modules with targets but
+// without credentials are left out. Its targets are the only clusters a module
+// can probe.
+func loadModules(config cl.Config, defaults *Options) map[string]*Options {
+	modules := make(map[string]*Options)
+	seen := make(map[string]bool)
+	for key := range config {
+		if !strings.HasPrefix(key, "modules.") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, "modules."), ".", 2)[0]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		module := *defaults
+		module.modules = nil
+		module.dbUsername, module.dbPassword = "", ""
+		applyModuleConfig(&module, config, "modules."+name+".")
+		for _, target := range config.GetStringArray("modules." + name + ".targets") {
+			module.targets = append(module.targets, targetURI(target, module.tlsEnabled))
+		}
+		if len(module.targets) == 0 {
+			log.Warn("Module ", name, " has no targets and can't be used to probe clusters")
+		} else if module.dbUsername == "" || module.dbPassword == "" {
+			log.Error("Module ", name, " has no credentials and won't be used to probe clusters")
+			continue
+		}
+		modules[name] = &module
+	}
+	return modules
+}
+
+// applyModuleConfig overrides options with the values found under prefix.
+// Unlike strings, booleans are only overridden when they are present.
+func applyModuleConfig(o *Options, config cl.Config, prefix string) {
+	if config.GetString(prefix+"db.user") != "" {
+		o.dbUsername = config.GetString(prefix + "db.user")
+	}
+	if config.GetString(prefix+"db.password") != "" {
+		o.dbPassword = config.GetString(prefix + "db.password")
+	}
+	if config.GetDuration(prefix+"db.timeout") != 0*time.Second {
+		o.dbTimeout = config.GetDuration(prefix + "db.timeout")
+	}
+	if config.GetInt(prefix+"db.idle-conns") != 0 {
+		o.dbIdleConns = config.GetInt(prefix + "db.idle-conns")
+	}
+	if config.GetInt(prefix+"db.idle-conns-per-host") != 0 {
+		o.dbIdleConnsPerHost = config.GetInt(prefix + "db.idle-conns-per-host")
+	}
+	if config.GetInt(prefix+"db.max-concurrency") != 0 {
+		o.dbMaxConcurrency = config.GetInt(prefix + "db.max-concurrency")
+	}
+	if config.GetFloat(prefix+"db.rate-limit") != 0 {
+		o.dbRateLimit = config.GetFloat(prefix + "db.rate-limit")
+	}
+	if config.Get(prefix+"db.retries") != nil {
+		o.dbRetries = config.GetInt(prefix + "db.retries")
+	}
+	if config.GetDuration(prefix+"db.retry-backoff") != 0*time.Second {
+		o.dbRetryBackoff = config.GetDuration(prefix + "db.retry-backoff")
+	}
+	if config.Get(prefix+"tls.enabled") != nil {
+		o.tlsEnabled = config.GetBool(prefix + "tls.enabled")
+	}
+	if config.Get(prefix+"tls.skip-insecure") != nil {
+		o.tlsSkipInsecure = config.GetBool(prefix + "tls.skip-insecure")
+	}
+	if config.GetString(prefix+"tls.ca-cert") != "" {
+		o.tlsCACert = config.GetString(prefix + "tls.ca-cert")
+	}
+	if config.GetString(prefix+"tls.client-cert") != "" {
+		o.tlsClientCert = config.GetString(prefix + "tls.client-cert")
+	}
+	if config.GetString(prefix+"tls.client-key") != "" {
+		o.tlsClientKey = config.GetString(prefix + "tls.client-key")
+	}
+	if config.Get(prefix+"scrape.cluster") != nil {
+		o.scrapeCluster = config.GetBool(prefix + "scrape.cluster")
+	}
+	if config.Get(prefix+"scrape.node") != nil {
+		o.scrapeNode = config.GetBool(prefix + "scrape.node")
+	}
+	if config.Get(prefix+"scrape.all-nodes") != nil {
+		o.scrapeAllNodes = config.GetBool(prefix + "scrape.all-nodes")
+	}
+	if config.Get(prefix+"scrape.bucket") != nil {
+		o.scrapeBucket = config.GetBool(prefix + "scrape.bucket")
+	}
+	if config.Get(prefix+"scrape.bucket-per-node") != nil {
+		o.scrapeBucketPerNode = config.GetBool(prefix + "scrape.bucket-per-node")
+	}
+	if config.Get(prefix+"scrape.xdcr") != nil {
+		o.scrapeXDCR = config.GetBool(prefix + "scrape.xdcr")
+	}
+	if config.Get(prefix+"scrape.query") != nil {
+		o.scrapeQuery = config.GetBool(prefix + "scrape.query")
+	}
+	if config.Get(prefix+"scrape.index") != nil {
+		o.scrapeIndex = config.GetBool(prefix + "scrape.index")
+	}
+	if config.Get(prefix+"scrape.fts") != nil {
+		o.scrapeFTS = config.GetBool(prefix + "scrape.fts")
+	}
+	if config.Get(prefix+"scrape.eventing") != nil {
+		o.scrapeEventing = config.GetBool(prefix + "scrape.eventing")
+	}
+	if config.Get(prefix+"scrape.analytics") != nil {
+		o.scrapeAnalytics = config.GetBool(prefix + "scrape.analytics")
+	}
+	if config.Get(prefix+"scrape.collections") != nil {
+		o.scrapeCollections = config.GetBool(prefix + "scrape.collections")
+	}
+	if config.Get(prefix+"scrape.sample-window") != nil {
+		o.scrapeSampleWindow = config.GetBool(prefix + "scrape.sample-window")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Adel Abdelhak.
+// Use of this source code is governed by the Apache
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	cl "github.com/blakelead/confloader"
+)
+
+func TestLoadModules(t *testing.T) {
+	defaults := &Options{dbUsername: "admin", dbPassword: "secret", dbRetries: 2, scrapeXDCR: true}
+	config := cl.Config{
+		"modules.prod.targets":           []string{"cb-prod-eu:18091", "https://cb-prod-us:18091"},
+		"modules.prod.db.user":           "prod",
+		"modules.prod.db.password":       "prod-secret",
+		"modules.prod.tls.enabled":       true,
+		"modules.prod.scrape.xdcr":       false,
+		"modules.dev.targets":            "cb-dev:8091",
+		"modules.dev.db.user":            "dev",
+		"modules.dev.db.password":        "dev-secret",
+		"modules.anonymous.targets":      []string{"cb-other:8091"},
+		"modules.passwordless.targets":   []string{"cb-other:8091"},
+		"modules.passwordless.db.user":   "admin",
+		"modules.untargeted.db.user":     "user",
+		"modules.untargeted.db.password": "password",
+	}
+	modules := loadModules(config, defaults)
+
+	tests := []struct {
+		name     string
+		exists   bool
+		username string
+		targets  []string
+		xdcr     bool
+	}{
+		{name: "prod", exists: true, username: "prod", targets: []string{"https://cb-prod-eu:18091", "https://cb-prod-us:18091"}},
+		{name: "dev", exists: true, username: "dev", targets: []string{"http://cb-dev:8091"}, xdcr: true},
+		{name: "untargeted", exists: true, username: "user", xdcr: true},
+		{name: "anonymous"},
+		{name: "passwordless"},
+	}
+	for _, test := range tests {
+		module, ok := modules[test.name]
+		if ok != test.exists {
+			t.Errorf("module %s loaded = %v, want %v", test.name, ok, test.exists)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if module.dbUsername != test.username || module.dbRetries != defaults.dbRetries {
+			t.Errorf("module %s has user %q and %d retries, want %q and %d", test.name, module.dbUsername, module.dbRetries, test.username, defaults.dbRetries)
+		}
+		if !reflect.DeepEqual(module.targets, test.targets) {
+			t.Errorf("module %s has targets %v, want %v", test.name, module.targets, test.targets)
+		}
+		if module.scrapeXDCR != test.xdcr {
+			t.Errorf("module %s scrapes XDCR = %v, want %v", test.name, module.scrapeXDCR, test.xdcr)
+		}
+	}
+	if len(modules) != 3 {
+		t.Errorf("loadModules() returned %d modules, want 3", len(modules))
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	runtimeOptions.modules = map[string]*Options{
+		"prod": {dbUsername: "admin", dbPassword: "secret", targets: []string{"http://cb-prod:8091"}},
+	}
+	defer func() { runtimeOptions.modules = nil }()
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query: "", code: http.StatusBadRequest},
+		{query: "target=cb-prod:8091", code: http.StatusBadRequest},
+		{query: "module=prod", code: http.StatusBadRequest},
+		{query: "target=cb-prod:8091&module=dev", code: http.StatusBadRequest},
+		{query: "target=cb-other:8091&module=prod", code: http.StatusForbidden},
+		{query: "target=https://cb-prod:8091&module=prod", code: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		probeHandler(w, httptest.NewRequest("GET", "/probe?"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("probe with %q responded %d, want %d", test.query, w.Code, test.code)
+		}
+	}
+}
+
+func TestProbeCollectorsFor(t *testing.T) {
+	module := &Options{targets: []string{"http://cb-prod:8091"}}
+	first, ok := probeCollectorsFor("prod", "http://cb-prod:8091", module)
+	if !ok || first == nil {
+		t.Fatalf("probeCollectorsFor() of an allowed target = %v, %v", first, ok)
+	}
+	if second, _ := probeCollectorsFor("prod", "http://cb-prod:8091", module); second != first {
+		t.Errorf("probeCollectorsFor() created new collectors for a target probed before")
+	}
+	if _, ok := probeCollectorsFor("prod", "http://cb-other:8091", module); ok {
+		t.Errorf("probeCollectorsFor() allowed a target missing from the module")
+	}
+}
+
+func TestCheckProbePath(t *testing.T) {
+	tests := []struct {
+		metrics string
+		probe   string
+		err     bool
+	}{
+		{metrics: "/metrics", probe: "/probe"},
+		{metrics: "/", probe: "/probe"},
+		{metrics: "/metrics", probe: "/metrics", err: true},
+		{metrics: "/", probe: "/", err: true},
+		{metrics: "/metrics", probe: "/", err: true},
+	}
+	for _, test := range tests {
+		err := checkProbePath(&Options{serverMetricsPath: test.metrics, serverProbePath: test.probe})
+		if (err != nil) != test.err {
+			t.Errorf("checkProbePath(%s, %s) error = %v, want error %v", test.metrics, test.probe, err, test.err)
+		}
+	}
+}